@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Since Go 1.5 the toolchain is written in Go, so building it needs an
+// existing Go installation, the bootstrap toolchain, passed to make.bash and
+// dist in GOROOT_BOOTSTRAP.
+
+// Before Go 1.12 there was no go.mod in src, so a bootstrap toolchain that
+// defaults to module mode can't build cmd/dist of those versions
+var goVersion112 = mustParseGoVersion("1.12")
+
+// bootstrapRequirement is the oldest bootstrap toolchain that can build a Go
+// version, and the release gonative downloads if there is none at hand
+type bootstrapRequirement struct {
+	Min      GoVersion
+	Download GoVersion
+}
+
+// bootstrapFor returns the bootstrap toolchain version needs, and false if it
+// is built with a C compiler and needs none
+func bootstrapFor(version GoVersion) (bootstrapRequirement, bool) {
+	switch {
+	case version.Less(goVersion15):
+		return bootstrapRequirement{}, false
+	case version.Less(mustParseGoVersion("1.20")):
+		return bootstrapRequirement{mustParseGoVersion("1.4"), mustParseGoVersion("1.4.3")}, true
+	case version.Less(mustParseGoVersion("1.22")):
+		v := mustParseGoVersion("1.17.13")
+		return bootstrapRequirement{v, v}, true
+	}
+	// from Go 1.22 on every other release raises the requirement to the
+	// release from a year before it, 1.22 and 1.23 need 1.20.6, 1.24 and
+	// 1.25 need 1.22.6 and so on
+	v := GoVersion{Major: 1, Minor: version.Minor - version.Minor%2 - 2, Patch: 6}
+	return bootstrapRequirement{v, v}, true
+}
+
+// bootstrap is the toolchain a build uses as GOROOT_BOOTSTRAP
+type bootstrap struct {
+	GoRoot  string
+	Version GoVersion
+
+	// how it was found, for reporting
+	Origin string
+
+	// the version of Go it builds
+	builds GoVersion
+}
+
+// findBootstrap finds a bootstrap toolchain for building opts.Version. It
+// uses opts.BootstrapPath if that is set, otherwise the oldest local Go
+// installation that is new enough, otherwise it downloads the binary
+// distribution of the required version for the host, building that from
+// source in turn if there is none. It returns nil if opts.Version needs no
+// bootstrap toolchain, along with what it downloaded.
+func findBootstrap(ctx context.Context, opts *Options) (b *bootstrap, downloads []Verification, err error) {
+	req, ok := bootstrapFor(opts.Version)
+	if !ok {
+		return nil, nil, nil
+	}
+	defer func() {
+		if b != nil {
+			b.builds = opts.Version
+		}
+	}()
+
+	if opts.BootstrapPath != "" {
+		goRoot, err := filepath.Abs(opts.BootstrapPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		version, err := goRootVersion(ctx, goRoot)
+		if err != nil {
+			Log.Warn("can't tell the version of the bootstrap toolchain, using it anyway", "path", goRoot, "err", err)
+		} else if version.Less(req.Min) {
+			return nil, nil, fmt.Errorf("Bootstrap toolchain %s is Go %s, but Go %s needs at least Go %s", goRoot, version, opts.Version, req.Min)
+		}
+		return &bootstrap{GoRoot: goRoot, Version: version, Origin: "-bootstrap"}, nil, nil
+	}
+
+	if local := localBootstrap(ctx, req); local != nil {
+		return local, nil, nil
+	}
+
+	Log.Info("no local Go to bootstrap with, fetching one", "version", req.Download, "min", req.Min)
+	return fetchBootstrap(ctx, opts, req.Download)
+}
+
+// fetchBootstrap downloads the binary distribution of version for the host
+// into the work directory. If there is none, it builds version from source,
+// bootstrapping that build the same way.
+func fetchBootstrap(ctx context.Context, opts *Options, version GoVersion) (*bootstrap, []Verification, error) {
+	bootOpts := *opts
+	bootOpts.Version = version
+	bootOpts.BootstrapPath = ""
+
+	host := hostPlatform()
+	path, v, err := host.Download(ctx, &bootOpts, nil)
+	if err == nil {
+		return &bootstrap{GoRoot: filepath.Join(path, "go"), Version: version, Origin: "downloaded " + v.URL}, []Verification{v}, nil
+	} else if !isNotFound(err) {
+		return nil, []Verification{v}, err
+	}
+
+	Log.Info("no binary distribution to bootstrap with, building it from source", "version", version, "plat", host.String())
+	path, v, err = srcPlatform.Download(ctx, &bootOpts, nil)
+	downloads := []Verification{v}
+	if err != nil {
+		return nil, downloads, err
+	}
+	goRoot := filepath.Join(path, "go")
+
+	// the bootstrap toolchain may need a bootstrap toolchain of its own
+	chain, chainDownloads, err := findBootstrap(ctx, &bootOpts)
+	downloads = append(downloads, chainDownloads...)
+	if err != nil {
+		return nil, downloads, err
+	}
+	if err := makeDotBash(ctx, goRoot, goRoot, chain); err != nil {
+		return nil, downloads, fmt.Errorf("Failed to build bootstrap toolchain Go %s: %v", version, err)
+	}
+	return &bootstrap{GoRoot: goRoot, Version: version, Origin: "built from source"}, downloads, nil
+}
+
+// localBootstrap returns the oldest local Go installation that satisfies req,
+// nil if there is none. Newer toolchains drift further from what old make.bash
+// scripts expect, so the oldest one is the safest bet.
+func localBootstrap(ctx context.Context, req bootstrapRequirement) (b *bootstrap) {
+	for _, goRoot := range localGoRoots(ctx) {
+		version, err := goRootVersion(ctx, goRoot)
+		Log.Debug("bootstrap candidate", "path", goRoot, "version", version, "err", err)
+		if err != nil || version.Less(req.Min) {
+			continue
+		}
+		if b == nil || version.Less(b.Version) {
+			b = &bootstrap{GoRoot: goRoot, Version: version, Origin: "local installation"}
+		}
+	}
+	return b
+}
+
+// localGoRoots lists the GOROOTs of Go installations on this machine: the go
+// command in PATH and the usual places to keep a bootstrap toolchain in
+func localGoRoots(ctx context.Context) (goRoots []string) {
+	if goCmd, err := exec.LookPath("go"); err == nil {
+		out, err := exec.CommandContext(ctx, goCmd, "env", "GOROOT").Output()
+		if root := strings.TrimSpace(string(out)); err == nil && root != "" {
+			goRoots = append(goRoots, root)
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		goRoots = append(goRoots, filepath.Join(home, "go1.4"))
+		sdks, _ := filepath.Glob(filepath.Join(home, "sdk", "go*"))
+		goRoots = append(goRoots, sdks...)
+	}
+	return
+}
+
+// goRootVersion tells which version of Go is installed at goRoot, from its
+// VERSION file or else by asking its go command
+func goRootVersion(ctx context.Context, goRoot string) (GoVersion, error) {
+	if f, err := os.Open(filepath.Join(goRoot, "VERSION")); err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		if s.Scan() {
+			return ParseGoVersion(strings.TrimSpace(s.Text()))
+		}
+	}
+
+	goCmd := goCommand(goRoot)
+	out, err := exec.CommandContext(ctx, goCmd, "version").Output()
+	if err != nil {
+		return GoVersion{}, err
+	}
+	// go version go1.20.6 linux/amd64
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return GoVersion{}, fmt.Errorf("Unexpected output from %s version: %q", goCmd, out)
+	}
+	return ParseGoVersion(fields[2])
+}
+
+// env returns the environment variables to build with the bootstrap
+// toolchain, none for a nil bootstrap. The bootstrap toolchain must not
+// switch to another toolchain, and must not use module mode for versions
+// without a go.mod in src.
+func (b *bootstrap) env() []string {
+	if b == nil {
+		return nil
+	}
+	env := []string{"GOROOT_BOOTSTRAP=" + b.GoRoot, "GOTOOLCHAIN=local"}
+	if b.builds.Less(goVersion112) {
+		env = append(env, "GO111MODULE=off")
+	}
+	return env
+}
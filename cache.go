@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+)
+
+// defaultCacheDir is where downloaded distributions are kept between builds
+// if no other cache directory is given
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gonative")
+}
+
+// cachePath returns where the archive for url is stored in the cache. Entries
+// are keyed by the URL and the checksum it is expected to have so that a
+// changed checksum never matches a stale archive.
+func cachePath(cacheDir, url, checksum string) string {
+	key := sha256.Sum256([]byte(url + "\n" + strings.ToLower(checksum)))
+	return filepath.Join(cacheDir, hex.EncodeToString(key[:])[:32], path.Base(url))
+}
+
+// fetch returns an open file with the archive for url, from the cache if it
+// holds a verified copy, otherwise downloaded into it. Archives without a known
+// checksum are stored with the digest they were downloaded with and checked
+// against that on later hits.
+func fetch(ctx context.Context, lg log15.Logger, d *downloader, url, cacheDir string, v *Verification) (*os.File, error) {
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir()
+	}
+	archivePath := cachePath(cacheDir, url, v.Expected)
+	lg = lg.New("cache", archivePath)
+
+	if f, err := openCached(lg, archivePath, v); err == nil {
+		lg.Info("using cached download")
+		v.Origin = "cache"
+		return f, nil
+	} else if !os.IsNotExist(err) {
+		lg.Warn("discarding cached download", "err", err)
+		os.Remove(archivePath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := d.download(ctx, lg, url, filepath.Dir(archivePath), path.Base(url), v)
+	if err != nil {
+		return nil, err
+	}
+	v.Origin = "download"
+
+	// commit to the cache only once the download is complete and verified
+	if err := commitCached(f.Name(), archivePath, v); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// commitCached moves a complete and verified download at tmpPath to
+// archivePath in the cache
+func commitCached(tmpPath, archivePath string, v *Verification) error {
+	if v.Expected == "" {
+		if err := ioutil.WriteFile(archivePath+"."+v.Algo, []byte(v.Digest+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, archivePath)
+}
+
+// openCached opens and verifies a cached archive
+func openCached(lg log15.Logger, archivePath string, v *Verification) (f *os.File, err error) {
+	f, err = os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	if err = hashFile(f, v); err != nil {
+		return nil, err
+	}
+	if v.Expected != "" {
+		if err = verifyDigest(lg, v); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	// no known checksum, so at least make sure the archive is unchanged
+	// since we downloaded it
+	recorded, err := ioutil.ReadFile(archivePath + "." + v.Algo)
+	if err != nil {
+		return nil, err
+	}
+	if want := strings.TrimSpace(string(recorded)); want != v.Digest {
+		err = fmt.Errorf("cached archive changed: %s digest was %s, now %s", v.Algo, want, v.Digest)
+		return nil, err
+	}
+	lg.Warn("no checksum for URL", v.Algo, v.Digest)
+	return f, nil
+}
+
+// hashFile hashes f from its current offset with the algorithm matching
+// v.Expected and records the digest in v
+func hashFile(f *os.File, v *Verification) error {
+	algo, h, err := checksumHash(v.Expected)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	v.Algo, v.Digest = algo, hex.EncodeToString(h.Sum(nil))
+	return nil
+}
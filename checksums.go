@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+)
+
+// fileChecksums maps archive file names (e.g. go1.5.2.linux-amd64.tar.gz) to
+// hex digests loaded from checksum manifests. They take precedence over the
+// built-in checksums table.
+var fileChecksums = map[string]string{}
+
+// builtinFileChecksums indexes the built-in checksums by file name so they
+// also apply to archives fetched from a mirror
+var (
+	builtinFileChecksums     map[string]string
+	builtinFileChecksumsOnce sync.Once
+)
+
+// checksumFor returns the known checksum for a distribution URL and where
+// it came from, or empty strings if there is none. Checksums are matched by
+// the archive's file name so that it doesn't matter where it is downloaded from.
+func checksumFor(url string) (sum, source string) {
+	name := path.Base(url)
+	if sum, ok := fileChecksums[name]; ok {
+		return sum, "manifest"
+	}
+	builtinFileChecksumsOnce.Do(func() {
+		builtinFileChecksums = make(map[string]string, len(checksums))
+		for u, sum := range checksums {
+			builtinFileChecksums[path.Base(u)] = sum
+		}
+	})
+	if sum, ok := builtinFileChecksums[name]; ok {
+		return sum, "built-in"
+	}
+	return "", ""
+}
+
+// Verification records how a downloaded archive was checked
+type Verification struct {
+	Platform Platform
+	URL      string
+
+	// expected digest and the table it was found in ("manifest" or
+	// "built-in"), both empty if the archive could not be verified
+	Expected string
+	Source   string
+
+	// hash algorithm and the digest of the downloaded archive
+	Algo   string
+	Digest string
+
+	// where the archive came from: "download", "cache" or "dist-dir"
+	Origin string
+}
+
+func (v *Verification) Verified() bool {
+	return v.Expected != ""
+}
+
+// Weak reports whether the archive was only verified with SHA-1, which is
+// all the built-in table has for many older releases. SHA-1 is not collision
+// resistant, so such a match doesn't count as verified for -require-checksum.
+func (v *Verification) Weak() bool {
+	return weakChecksum(v.Expected)
+}
+
+// weakChecksum reports whether checksum is a SHA-1 digest
+func weakChecksum(checksum string) bool {
+	return len(checksum) == sha1.Size*2
+}
+
+// logVerifications logs a summary of how each downloaded archive was verified
+func logVerifications(vs []Verification) {
+	for _, v := range vs {
+		if v.Weak() {
+			Log.Warn("download only verified with SHA-1, pass a go.dev/dl manifest with -checksums to verify it with SHA-256", "plat", v.Platform.String(), "url", v.URL, "digest", v.Digest, "source", v.Source, "from", v.Origin)
+		} else if v.Verified() {
+			Log.Info("verified download", "plat", v.Platform.String(), "url", v.URL, "algo", v.Algo, "digest", v.Digest, "source", v.Source, "from", v.Origin)
+		} else {
+			Log.Warn("unverified download", "plat", v.Platform.String(), "url", v.URL, v.Algo, v.Digest, "from", v.Origin)
+		}
+	}
+}
+
+// the subset of the https://go.dev/dl/?mode=json format that we care about
+type dlRelease struct {
+	Files []struct {
+		Filename string `json:"filename"`
+		SHA256   string `json:"sha256"`
+	} `json:"files"`
+}
+
+// LoadChecksums reads a checksum manifest and merges it into the table used
+// to verify downloads. The manifest is either the JSON served by
+// https://go.dev/dl/?mode=json&include=all or the output of sha256sum.
+func LoadChecksums(manifestPath string) error {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var sums map[string]string
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		sums, err = parseJSONManifest(trimmed)
+	} else {
+		sums, err = parseSumManifest(data)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to parse checksum manifest %s: %v", manifestPath, err)
+	}
+
+	for name, sum := range sums {
+		fileChecksums[name] = sum
+	}
+	Log.Info("loaded checksum manifest", "path", manifestPath, "entries", len(sums))
+	return nil
+}
+
+func parseJSONManifest(data []byte) (map[string]string, error) {
+	var releases []dlRelease
+	if data[0] == '{' {
+		// a single release, like the one served by ?mode=json&version=...
+		var r dlRelease
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		releases = append(releases, r)
+	} else if err := json.Unmarshal(data, &releases); err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string)
+	for _, r := range releases {
+		for _, f := range r.Files {
+			if f.Filename == "" || f.SHA256 == "" {
+				continue
+			}
+			if algo, _, err := checksumHash(f.SHA256); err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Filename, err)
+			} else if algo != "sha256" {
+				return nil, fmt.Errorf("%s: Malformed checksum %q: not a SHA-256 hex digest", f.Filename, f.SHA256)
+			}
+			sums[f.Filename] = strings.ToLower(f.SHA256)
+		}
+	}
+	return sums, nil
+}
+
+// parses lines of the form "<hex digest>  <file name>" as written by
+// sha256sum (and sha1sum). Blank lines and # comments are ignored.
+func parseSumManifest(data []byte) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected '<digest> <file>', got %q", lineNo, line)
+		}
+		sum, name := fields[0], fields[1]
+		if _, _, err := checksumHash(sum); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		// binary mode entries are prefixed with '*'
+		name = path.Base(strings.TrimPrefix(name, "*"))
+		sums[name] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
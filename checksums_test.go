@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testSHA256 = "4ff3f1b39ab7e5b2e3f4b7b8d4a1a3b9c0e1f2a3b4c5d6e7f8091a2b3c4d5e6f"
+	testSHA1   = "cae87ed095e8d94a81871281d35da7829bd1234e"
+)
+
+func TestParseJSONManifest(t *testing.T) {
+	list := `[
+		{"version": "go1.5.2", "files": [
+			{"filename": "go1.5.2.linux-amd64.tar.gz", "sha256": "4FF3F1B39AB7E5B2E3F4B7B8D4A1A3B9C0E1F2A3B4C5D6E7F8091A2B3C4D5E6F"},
+			{"filename": "go1.5.2.src.tar.gz", "sha256": ""}
+		]},
+		{"version": "go1.4.3", "files": [
+			{"filename": "go1.4.3.darwin-amd64.pkg", "sha256": "` + testSHA256 + `"}
+		]}
+	]`
+	sums, err := parseJSONManifest([]byte(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"go1.5.2.linux-amd64.tar.gz": testSHA256,
+		"go1.4.3.darwin-amd64.pkg":   testSHA256,
+	}
+	if !reflect.DeepEqual(sums, want) {
+		t.Errorf("got %v, want %v", sums, want)
+	}
+
+	// a single release
+	single := `{"version": "go1.5.2", "files": [{"filename": "go1.5.2.linux-386.tar.gz", "sha256": "` + testSHA256 + `"}]}`
+	sums, err = parseJSONManifest([]byte(single))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums["go1.5.2.linux-386.tar.gz"] != testSHA256 || len(sums) != 1 {
+		t.Errorf("single release: got %v", sums)
+	}
+
+	for _, sum := range []string{"xyz", testSHA256[:63], testSHA1} {
+		bad := `[{"files": [{"filename": "go1.5.2.linux-amd64.tar.gz", "sha256": "` + sum + `"}]}]`
+		if _, err := parseJSONManifest([]byte(bad)); err == nil {
+			t.Errorf("digest %q accepted", sum)
+		}
+	}
+}
+
+func TestParseSumManifest(t *testing.T) {
+	manifest := `# go1.5.2
+` + testSHA256 + `  go1.5.2.linux-amd64.tar.gz
+
+` + testSHA1 + ` *dl/go1.5.2.windows-amd64.zip
+`
+	sums, err := parseSumManifest([]byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"go1.5.2.linux-amd64.tar.gz": testSHA256,
+		"go1.5.2.windows-amd64.zip":  testSHA1,
+	}
+	if !reflect.DeepEqual(sums, want) {
+		t.Errorf("got %v, want %v", sums, want)
+	}
+
+	for _, bad := range []string{
+		testSHA256,
+		testSHA256 + " go1.5.2.linux-amd64.tar.gz extra",
+		"not-hex go1.5.2.linux-amd64.tar.gz",
+		testSHA256[:50] + " go1.5.2.linux-amd64.tar.gz",
+	} {
+		if _, err := parseSumManifest([]byte(bad)); err == nil {
+			t.Errorf("line %q accepted", bad)
+		}
+	}
+}
+
+func TestLoadChecksumsOverridesBuiltin(t *testing.T) {
+	const url = "https://storage.googleapis.com/golang/go1.5.2.linux-amd64.tar.gz"
+	if _, source := checksumFor(url); source != "built-in" {
+		t.Fatalf("no built-in checksum for %s", url)
+	}
+
+	tmp, err := ioutil.TempDir("", "checksums-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	manifest := filepath.Join(tmp, "SHA256SUMS")
+	if err := ioutil.WriteFile(manifest, []byte(testSHA256+"  go1.5.2.linux-amd64.tar.gz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(fileChecksums, "go1.5.2.linux-amd64.tar.gz")
+	if err := LoadChecksums(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// matched by file name, so it applies to mirrors too
+	for _, u := range []string{url, "https://mirror.example.com/go/go1.5.2.linux-amd64.tar.gz"} {
+		if sum, source := checksumFor(u); sum != testSHA256 || source != "manifest" {
+			t.Errorf("checksumFor(%s) = %s, %s, want the manifest entry", u, sum, source)
+		}
+	}
+
+	if err := ioutil.WriteFile(manifest, []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadChecksums(manifest); err == nil {
+		t.Error("malformed manifest loaded without error")
+	}
+}
@@ -34,7 +34,8 @@ import (
 var errCopyFileWithDir = errors.New("dir argument to CopyFile")
 
 // CopyFile copies the file with path src to dst. The new file must not exist.
-// It is created with the same permissions as src.
+// It is created with the same permissions and modification time as src, so
+// copied packages don't look stale to the go tool.
 func CopyFile(dst, src string) error {
 	rf, err := os.Open(src)
 	if err != nil {
@@ -57,28 +58,80 @@ func CopyFile(dst, src string) error {
 		wf.Close()
 		return err
 	}
-	return wf.Close()
+	if err := wf.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, rstat.ModTime(), rstat.ModTime())
+}
+
+// CopyGlob copies the files matching the filepath.Glob pattern into the
+// directory dst and returns the paths of the copies. Directories matching
+// the pattern are skipped.
+func CopyGlob(dst, pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var copied []string
+	for _, src := range matches {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return copied, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		dstPath := filepath.Join(dst, filepath.Base(src))
+		if err := CopyFile(dstPath, src); err != nil {
+			return copied, err
+		}
+		copied = append(copied, dstPath)
+	}
+	return copied, nil
 }
 
 // CopyAll copies the file or (recursively) the directory at src to dst.
-// Permissions are preserved. dst must not already exist.
+// Permissions are preserved and symlinks are copied as symlinks. dst must not
+// already exist.
 func CopyAll(dst, src string) error {
 	Log.Info("copy recursive", "dst", dst, "src", src)
-	return filepath.Walk(src, makeWalkFn(dst, src))
+	prog := progressDisplay.Track("copy "+filepath.Base(dst), false)
+	defer prog.Finish()
+	if prog != nil {
+		prog.SetTotal(countFiles(src))
+	}
+	return filepath.Walk(src, makeWalkFn(dst, src, prog))
+}
+
+// countFiles returns how many files are in the tree at root
+func countFiles(root string) (n int64) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return
 }
 
-func makeWalkFn(dst, src string) filepath.WalkFunc {
+func makeWalkFn(dst, src string, prog *progress) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		dstPath := filepath.Join(dst, strings.TrimPrefix(path, src))
 		if info.IsDir() {
-			err := os.Mkdir(dstPath, info.Mode())
-			if err == nil || os.IsExist(err) {
-				return nil
+			return os.Mkdir(dstPath, info.Mode())
+		}
+		prog.Add(1)
+		if info.Mode()&os.ModeSymlink != 0 {
+			// copy the link itself, its target may be a directory or
+			// not exist at all
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
 			}
-			return err
+			return os.Symlink(target, dstPath)
 		}
 		return CopyFile(dstPath, path)
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyAllSymlinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	for _, dir := range []string{"src/misc/cgo", "src/lib"} {
+		if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "misc", "cgo", "test.go"), []byte("package cgo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"lib/cgo":     "../misc/cgo",
+		"lib/test.go": "../misc/cgo/test.go",
+		"lib/missing": "nowhere",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	if err := CopyAll(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	for link, want := range links {
+		target, err := os.Readlink(filepath.Join(dst, link))
+		if err != nil {
+			t.Errorf("%s: %v", link, err)
+		} else if target != want {
+			t.Errorf("%s points to %q, want %q", link, target, want)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "misc", "cgo", "test.go")); err != nil || string(data) != "package cgo" {
+		t.Errorf("copied file has %q, %v", data, err)
+	}
+}
+
+func TestCopyGlob(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	for _, dir := range []string{src, dst, filepath.Join(src, "z_linux_amd64.d")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"zasm_linux_amd64.h", "zsys_linux_amd64.s", "zsys_linux_386.s", "proc.c"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	copied, err := CopyGlob(dst, filepath.Join(src, "z*_linux_amd64.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dst, "zasm_linux_amd64.h"), filepath.Join(dst, "zsys_linux_amd64.s")}
+	if len(copied) != len(want) || copied[0] != want[0] || copied[1] != want[1] {
+		t.Errorf("copied %v, want %v", copied, want)
+	}
+	if names := dirNames(t, dst); len(names) != 2 {
+		t.Errorf("%s has %v, want only the two matching files", dst, names)
+	}
+}
+
+func dirNames(t *testing.T, dir string) (names []string) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return
+}
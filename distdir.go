@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+)
+
+// distFileName is the name of the archive for a platform as published on the
+// download site, e.g. go1.5.2.linux-amd64.tar.gz or go1.5.2.windows-386.zip
+func (p *Platform) distFileName(version GoVersion) string {
+	return path.Base(p.distURL(version, ""))
+}
+
+// hasDistFile reports whether distDir has the archive, in any format, or
+// the installer of version for p
+func hasDistFile(distDir string, p Platform, version GoVersion) bool {
+	_, ok := findDistFile(distDir, p.distURLs(version, "", true))
+	return ok
+}
+
+// findDistFile returns the first of urls whose file is in distDir
+func findDistFile(distDir string, urls []string) (string, bool) {
+	for _, url := range urls {
+		if _, err := os.Stat(filepath.Join(distDir, path.Base(url))); err == nil {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+// missingDistFiles returns the archives a build needs that are not in
+// distDir, including those of the bootstrap toolchain if needsBootstrap is
+// set
+func missingDistFiles(ctx context.Context, distDir string, opts *Options, needsBootstrap bool) (missing []string) {
+	// newer versions build the platforms' packages instead of copying them
+	var platforms []Platform
+	if shipsPkg(opts.Version) {
+		platforms = opts.Platforms
+	}
+	if opts.SrcPath == "" {
+		platforms = append([]Platform{srcPlatform}, platforms...)
+	}
+	for _, p := range platforms {
+		if !hasDistFile(distDir, p, opts.Version) {
+			missing = append(missing, p.distFileName(opts.Version))
+		}
+	}
+	if needsBootstrap && opts.BootstrapPath == "" {
+		missing = append(missing, missingBootstrapFiles(ctx, distDir, opts.Version)...)
+	}
+	return
+}
+
+// missingBootstrapFiles returns the archives findBootstrap needs to bootstrap
+// version that are not in distDir. There are none if there is a local Go to
+// bootstrap with. Otherwise it needs the host's binary distribution of the
+// bootstrap version, or its source and what that needs to bootstrap in turn.
+func missingBootstrapFiles(ctx context.Context, distDir string, version GoVersion) []string {
+	req, ok := bootstrapFor(version)
+	if !ok || localBootstrap(ctx, req) != nil {
+		return nil
+	}
+	host := hostPlatform()
+	if hasDistFile(distDir, host, req.Download) {
+		return nil
+	}
+	if hasDistFile(distDir, srcPlatform, req.Download) {
+		return missingBootstrapFiles(ctx, distDir, req.Download)
+	}
+	return []string{fmt.Sprintf("%s (or %s, to bootstrap Go %s)", host.distFileName(req.Download), srcPlatform.distFileName(req.Download), version)}
+}
+
+// checkDistDir makes sure every archive the build needs is in the local
+// distribution directory so an offline build fails up front instead of
+// part way through
+func checkDistDir(ctx context.Context, opts *Options, needsBootstrap bool) error {
+	if missing := missingDistFiles(ctx, opts.DistDir, opts, needsBootstrap); len(missing) > 0 {
+		return fmt.Errorf("Missing distributions in %s: %s", opts.DistDir, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// openDistFile opens and verifies the archive called name from the local
+// distribution directory
+func openDistFile(lg log15.Logger, distDir, name string, v *Verification) (f *os.File, err error) {
+	archivePath := filepath.Join(distDir, name)
+	lg.Info("using local distribution", "path", archivePath)
+	f, err = os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = hashFile(f, v); err == nil {
+		err = verifyDigest(lg, v)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	v.Origin = "dist-dir"
+	return f, nil
+}
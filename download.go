@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// downloader fetches distributions over HTTP. Transient failures are retried
+// with exponential backoff and resume where the previous attempt stopped.
+type downloader struct {
+	client *http.Client
+
+	// how long to wait for a connection, response headers or the next bytes
+	// of the body before giving up on an attempt
+	timeout time.Duration
+
+	// how many times to retry after the first attempt fails
+	retries int
+
+	// wait before the first retry, doubled for each one after that
+	backoff time.Duration
+}
+
+func newDownloader(opts *Options) *downloader {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &downloader{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+			},
+		},
+		timeout: timeout,
+		retries: opts.Retries,
+		backoff: time.Second,
+	}
+}
+
+// retryableError marks a failure that might not happen again on another attempt
+type retryableError struct {
+	error
+}
+
+// statusError reports an unexpected HTTP response to a download request
+type statusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Bad response for download (%s): %v", e.URL, e.StatusCode)
+}
+
+// isNotFound reports whether err means a distribution doesn't exist, locally
+// or on the server
+func isNotFound(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.StatusCode == http.StatusNotFound
+	}
+	return os.IsNotExist(err)
+}
+
+// download fetches url into a temporary file in dir while hashing it and
+// checks the result against v.Expected. The algorithm and actual digest are
+// recorded in v.
+func (d *downloader) download(ctx context.Context, lg log15.Logger, url, dir, name string, v *Verification) (_ *os.File, err error) {
+	algo, h, err := checksumHash(v.Expected)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, name+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	lg.Info("start download")
+	prog := progressDisplay.Track(v.Platform.String()+" download", true)
+	defer prog.Finish()
+	if err = d.fetchTo(ctx, lg, url, &fileSink{f, h}, prog); err != nil {
+		return nil, err
+	}
+
+	v.Algo, v.Digest = algo, hex.EncodeToString(h.Sum(nil))
+	if err = verifyDigest(lg, v); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// downloadSink receives the body of a download as it arrives
+type downloadSink interface {
+	io.Writer
+
+	// Truncate drops anything written past offset, e.g. by a failed write,
+	// so that the download can resume there
+	Truncate(offset int64) error
+}
+
+// fileSink writes a download to a file and a hash
+type fileSink struct {
+	f *os.File
+	h hash.Hash
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	return io.MultiWriter(s.f, s.h).Write(p)
+}
+
+func (s *fileSink) Truncate(offset int64) error {
+	if err := s.f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// fetchTo downloads url into sink, retrying transient failures until ctx is
+// done
+func (d *downloader) fetchTo(ctx context.Context, lg log15.Logger, url string, sink downloadSink, prog *progress) error {
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		var err error
+		offset, err = d.get(ctx, url, sink, prog, offset)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := err.(retryableError); !ok || attempt >= d.retries {
+			return err
+		}
+		wait := d.backoff << uint(attempt)
+		if wait > maxBackoff || wait <= 0 {
+			wait = maxBackoff
+		}
+		lg.Warn("download failed, retrying", "err", err, "attempt", attempt+1, "offset", offset, "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// get requests url from offset on and writes the response body to sink,
+// which must already hold exactly the first offset bytes. If the server
+// doesn't honor the range request, the bytes sink already has are skipped.
+// It returns how many bytes sink holds afterwards.
+func (d *downloader) get(ctx context.Context, url string, sink downloadSink, prog *progress, offset int64) (int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return offset, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// canceled when the body stalls as well as with ctx
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := d.client.Do(req.WithContext(reqCtx))
+	if err != nil {
+		return offset, retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	var skip int64
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// resuming where the last attempt left off
+	case resp.StatusCode == http.StatusOK:
+		// the whole file, including what we already have
+		skip = offset
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return offset, retryableError{&statusError{url, resp.StatusCode}}
+	default:
+		return offset, &statusError{url, resp.StatusCode}
+	}
+
+	// drop anything a failed write may have left past offset
+	if err := sink.Truncate(offset); err != nil {
+		return offset, err
+	}
+
+	prog.Set(offset)
+	if resp.ContentLength >= 0 {
+		prog.SetTotal(offset - skip + resp.ContentLength)
+	}
+
+	body := &idleTimeoutReader{rd: resp.Body, timeout: d.timeout, timer: time.AfterFunc(d.timeout, cancel)}
+	defer body.timer.Stop()
+	w := &sinkWriter{w: sink}
+	_, err = io.CopyN(ioutil.Discard, body, skip)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(io.MultiWriter(w, prog), body)
+		offset += n
+	}
+	if w.err != nil {
+		// the sink failed, there's no point in trying again
+		return offset, w.err
+	}
+	if err != nil && ctx.Err() != nil {
+		return offset, ctx.Err()
+	}
+	if err != nil && reqCtx.Err() != nil {
+		err = fmt.Errorf("download stalled, no data for %v", d.timeout)
+	}
+	if err != nil {
+		return offset, retryableError{err}
+	}
+	return offset, nil
+}
+
+// sinkWriter remembers why writing to a sink failed
+type sinkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// idleTimeoutReader fires its timer if no read completes within timeout
+type idleTimeoutReader struct {
+	rd      io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
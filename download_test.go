@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves data, but the first drops requests hang up half way
+// through the body and the first errors requests after that fail with a 503
+type flakyServer struct {
+	data    []byte
+	ranges  bool
+	drops   int
+	errors  int
+	missing bool
+
+	mu       sync.Mutex
+	requests []string // Range headers of the requests
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Get("Range"))
+	drop, fail := s.drops > 0, s.drops == 0 && s.errors > 0
+	if drop {
+		s.drops--
+	} else if fail {
+		s.errors--
+	}
+	s.mu.Unlock()
+
+	switch {
+	case s.missing:
+		http.NotFound(w, r)
+	case fail:
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+	case drop:
+		// promise the whole file, send half of it and hang up
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(s.data))
+		buf.Write(s.data[:len(s.data)/2])
+		buf.Flush()
+		conn.Close()
+	case s.ranges:
+		http.ServeContent(w, r, "archive.tar.gz", time.Time{}, bytes.NewReader(s.data))
+	default:
+		// ignores Range and always sends everything
+		w.Header().Set("Content-Length", fmt.Sprint(len(s.data)))
+		w.Write(s.data)
+	}
+}
+
+func (s *flakyServer) ranged() (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.requests {
+		if r != "" {
+			n++
+		}
+	}
+	return
+}
+
+func testData(t *testing.T) []byte {
+	data := make([]byte, 256*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testDownloader() *downloader {
+	return &downloader{client: http.DefaultClient, timeout: 5 * time.Second, retries: 3, backoff: time.Millisecond}
+}
+
+// fetchFile downloads url with fetchTo into a fileSink and returns what
+// ended up in the file
+func fetchFile(t *testing.T, url string) ([]byte, error) {
+	f, err := ioutil.TempFile("", "download-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := testDownloader().fetchTo(context.Background(), Log, url, &fileSink{f, sha256.New()}, nil); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(f.Name())
+}
+
+// fetchStreamed downloads url with fetchTo into a streamSink and returns
+// what came out of the pipe along with the hash of the stream
+func fetchStreamed(t *testing.T, url string) ([]byte, []byte, error) {
+	pr, pw := io.Pipe()
+	sink := &streamSink{w: pw, h: sha256.New()}
+	got := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(pr)
+		got <- data
+	}()
+	err := testDownloader().fetchTo(context.Background(), Log, url, sink, nil)
+	pw.CloseWithError(err)
+	return <-got, sink.h.Sum(nil), err
+}
+
+func TestFetchToResumes(t *testing.T) {
+	data := testData(t)
+	for _, ranges := range []bool{true, false} {
+		srv := &flakyServer{data: data, ranges: ranges, drops: 1}
+		ts := httptest.NewServer(srv)
+
+		got, err := fetchFile(t, ts.URL)
+		if err != nil {
+			t.Fatalf("ranges=%v: %v", ranges, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("ranges=%v: downloaded %d bytes that don't match the %d served", ranges, len(got), len(data))
+		}
+		if len(srv.requests) != 2 {
+			t.Errorf("ranges=%v: made %d requests, want 2", ranges, len(srv.requests))
+		}
+		if want := fmt.Sprintf("bytes=%d-", len(data)/2); srv.requests[1] != want {
+			t.Errorf("ranges=%v: retried with Range %q, want %q", ranges, srv.requests[1], want)
+		}
+		ts.Close()
+	}
+}
+
+func TestFetchToStreamResumes(t *testing.T) {
+	data := testData(t)
+	sum := sha256.Sum256(data)
+	for _, ranges := range []bool{true, false} {
+		srv := &flakyServer{data: data, ranges: ranges, drops: 1}
+		ts := httptest.NewServer(srv)
+
+		got, h, err := fetchStreamed(t, ts.URL)
+		if err != nil {
+			t.Fatalf("ranges=%v: %v", ranges, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("ranges=%v: streamed %d bytes that don't match the %d served", ranges, len(got), len(data))
+		}
+		if !bytes.Equal(h, sum[:]) {
+			t.Errorf("ranges=%v: stream hashed to %x, want %x", ranges, h, sum)
+		}
+		if srv.ranged() != 1 {
+			t.Errorf("ranges=%v: made %d range requests, want 1", ranges, srv.ranged())
+		}
+		ts.Close()
+	}
+}
+
+func TestFetchToRetriesServerErrors(t *testing.T) {
+	data := testData(t)
+	srv := &flakyServer{data: data, ranges: true, errors: 2}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	got, err := fetchFile(t, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes that don't match the %d served", len(got), len(data))
+	}
+	if len(srv.requests) != 3 {
+		t.Errorf("made %d requests, want 3", len(srv.requests))
+	}
+}
+
+func TestFetchToGivesUp(t *testing.T) {
+	srv := &flakyServer{data: testData(t), ranges: true, errors: 10}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	if _, err := fetchFile(t, ts.URL); err == nil {
+		t.Fatal("download succeeded although every attempt failed")
+	}
+	if want := testDownloader().retries + 1; len(srv.requests) != want {
+		t.Errorf("made %d requests, want %d", len(srv.requests), want)
+	}
+}
+
+func TestFetchToNotFound(t *testing.T) {
+	srv := &flakyServer{missing: true}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	_, err := fetchFile(t, ts.URL)
+	if !isNotFound(err) {
+		t.Fatalf("got %v, want a not found error", err)
+	}
+	if len(srv.requests) != 1 {
+		t.Errorf("made %d requests, want 1", len(srv.requests))
+	}
+
+	if _, _, err := fetchStreamed(t, ts.URL); !isNotFound(err) {
+		t.Fatalf("streaming got %v, want a not found error", err)
+	}
+}
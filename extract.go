@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// limits on what a single archive may extract, far above what any Go
+// distribution needs
+const (
+	maxExtractSize    = 4 << 30
+	maxExtractEntries = 250000
+)
+
+// extractError reports an archive entry that was refused
+type extractError struct {
+	Entry  string
+	Reason string
+}
+
+func (e *extractError) Error() string {
+	return fmt.Sprintf("refusing to extract %q: %s", e.Entry, e.Reason)
+}
+
+// extractor writes archive entries below dest. It refuses entries that would
+// end up outside of it, whether through their names, through symlinks or
+// hard links, or by writing through a symlink extracted earlier, and it caps
+// the total size and number of entries.
+type extractor struct {
+	dest       string
+	maxSize    int64
+	maxEntries int
+
+	size    int64
+	entries int
+
+	// which entries to extract, nil for all of them
+	filter *extractFilter
+
+	// extraction stops with an error once ctx is done
+	ctx context.Context
+
+	// directories get their final permissions and mod times once everything
+	// inside of them is written, in case they aren't writable
+	dirs []extractedDir
+}
+
+type extractedDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newExtractor(ctx context.Context, dest string, filter *extractFilter) (*extractor, error) {
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{dest: dest, maxSize: maxExtractSize, maxEntries: maxExtractEntries, filter: filter, ctx: ctx}, nil
+}
+
+// Wants reports whether the entry called name passes the filter. Entries
+// that don't are silently skipped by the methods that extract them, but
+// checking first saves reading their contents.
+func (x *extractor) Wants(name string) bool {
+	return x.filter.Match(name)
+}
+
+// entryPath validates the name of an archive entry and returns the cleaned,
+// slash separated path relative to dest
+func entryPath(name string) (string, error) {
+	// zip files written on windows may use backslashes
+	slashed := strings.Replace(name, `\`, "/", -1)
+	switch {
+	case strings.HasPrefix(slashed, "/"):
+		return "", &extractError{name, "absolute path"}
+	case len(slashed) >= 2 && slashed[1] == ':':
+		return "", &extractError{name, "windows drive path"}
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", &extractError{name, "path contains '..'"}
+		}
+	}
+	rel := path.Clean(slashed)
+	if rel == "." {
+		return "", &extractError{name, "empty path"}
+	}
+	return rel, nil
+}
+
+// path returns where the entry called name is written to. None of the
+// directories leading up to it may be symlinks.
+func (x *extractor) path(name string) (string, error) {
+	rel, err := entryPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(rel, "/")
+	dir := x.dest
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", &extractError{name, fmt.Sprintf("parent %q is a symlink", strings.TrimPrefix(dir, x.dest+string(filepath.Separator)))}
+		}
+	}
+	return filepath.Join(x.dest, filepath.FromSlash(rel)), nil
+}
+
+// count accounts for one more entry and fails once there are too many or
+// the extraction was canceled
+func (x *extractor) count(name string) error {
+	if err := x.ctx.Err(); err != nil {
+		return err
+	}
+	x.entries++
+	if x.entries > x.maxEntries {
+		return &extractError{name, fmt.Sprintf("archive has more than %d entries", x.maxEntries)}
+	}
+	return nil
+}
+
+// prepare creates the parent directories for p and removes whatever p is
+// now so that an entry never writes through an existing symlink
+func (x *extractor) prepare(p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// File extracts a regular file with contents from r
+func (x *extractor) File(name string, r io.Reader, mode os.FileMode, modTime time.Time) error {
+	if !x.Wants(name) {
+		return nil
+	}
+	if err := x.count(name); err != nil {
+		return err
+	}
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if err := x.prepare(p); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	// read one byte past the limit to find out if it was exceeded
+	remaining := x.maxSize - x.size
+	n, err := io.Copy(f, io.LimitReader(r, remaining+1))
+	x.size += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n > remaining {
+		return &extractError{name, fmt.Sprintf("archive extracts to more than %d bytes", x.maxSize)}
+	}
+	if !modTime.IsZero() {
+		return os.Chtimes(p, modTime, modTime)
+	}
+	return nil
+}
+
+// Dir extracts a directory
+func (x *extractor) Dir(name string, mode os.FileMode, modTime time.Time) error {
+	if !x.Wants(name) {
+		return nil
+	}
+	if err := x.count(name); err != nil {
+		return err
+	}
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+		return &extractError{name, "directory replaces an existing file or symlink"}
+	}
+	if err := os.MkdirAll(p, 0755); err != nil {
+		return err
+	}
+	x.dirs = append(x.dirs, extractedDir{p, mode.Perm(), modTime})
+	return nil
+}
+
+// Symlink extracts a symlink to target. The target must be relative and
+// stay inside of dest, and it may only go up at its start: "../../pkg/tool"
+// is fine but "up/.." is not, since up may be a symlink itself, extracted
+// before or after this one.
+func (x *extractor) Symlink(name, target string) error {
+	if !x.Wants(name) {
+		return nil
+	}
+	if err := x.count(name); err != nil {
+		return err
+	}
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	slashed := strings.Replace(target, `\`, "/", -1)
+	if strings.HasPrefix(slashed, "/") || (len(slashed) >= 2 && slashed[1] == ':') {
+		return &extractError{name, fmt.Sprintf("symlink to absolute path %q", target)}
+	}
+	parts := strings.Split(slashed, "/")
+	up := 0
+	for up < len(parts) && parts[up] == ".." {
+		up++
+	}
+	for _, part := range parts[up:] {
+		if part == ".." {
+			return &extractError{name, fmt.Sprintf("symlink to %q goes up after going down", target)}
+		}
+	}
+	rel, _ := entryPath(name)
+	resolved := path.Join(path.Dir(rel), slashed)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return &extractError{name, fmt.Sprintf("symlink to %q points outside of the destination", target)}
+	}
+	// links extracted earlier rely on directories staying directories
+	if fi, err := os.Lstat(p); err == nil && fi.IsDir() {
+		return &extractError{name, "symlink replaces a directory"}
+	}
+	if err := x.prepare(p); err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+// Hardlink links name to target, a file extracted earlier from the same archive
+func (x *extractor) Hardlink(name, target string) error {
+	if !x.Wants(name) {
+		return nil
+	}
+	if err := x.count(name); err != nil {
+		return err
+	}
+	p, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	targetPath, err := x.path(target)
+	if err != nil {
+		return &extractError{name, fmt.Sprintf("bad hard link target: %v", err)}
+	}
+	fi, err := os.Lstat(targetPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return &extractError{name, fmt.Sprintf("hard link target %q is not an extracted file", target)}
+	}
+	if err := x.prepare(p); err != nil {
+		return err
+	}
+	return os.Link(targetPath, p)
+}
+
+// Close applies the permissions and mod times of the extracted directories
+func (x *extractor) Close() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		// a mode of 0 means none was recorded, so keep the default
+		if d.mode != 0 {
+			if err := os.Chmod(d.path, d.mode); err != nil {
+				return err
+			}
+		}
+		if !d.modTime.IsZero() {
+			if err := os.Chtimes(d.path, d.modTime, d.modTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// extractFilter selects which entries of an archive are extracted. Patterns
+// are path.Match globs for slash separated paths like go/pkg/linux_amd64. A
+// pattern matching a directory also matches everything inside of it.
+//
+// An entry is extracted if it matches one of the Include patterns, or there
+// are none, and none of the Exclude patterns. A nil filter extracts
+// everything.
+type extractFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Match reports whether the archive entry called name should be extracted
+func (f *extractFilter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+	rel, err := entryPath(name)
+	if err != nil {
+		// let the extractor refuse it
+		return true
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include, rel) {
+		return false
+	}
+	return !matchAny(f.Exclude, rel)
+}
+
+// matchAny reports whether one of patterns matches rel or a directory it is in
+func matchAny(patterns []string, rel string) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		prefix := path.Join(parts[:i+1]...)
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
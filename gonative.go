@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/codegangsta/cli"
@@ -17,6 +21,12 @@ import (
 
 var Log = log.Root()
 
+// Go 1.4 moved the runtime sources from src/pkg/runtime to src/runtime
+var goVersion14 = mustParseGoVersion("1.4")
+
+// Go 1.5 stopped generating per-platform runtime files (z*_GOOS_GOARCH.*)
+var goVersion15 = mustParseGoVersion("1.5")
+
 const usage = `build Go installations with native stdlib packages
 
 DESCRIPTION:
@@ -44,10 +54,63 @@ KwIDAQAB
 -----END PUBLIC KEY-----`
 
 type Options struct {
-	Version    string
+	Version    GoVersion
 	SrcPath    string
 	TargetPath string
 	Platforms  []Platform
+
+	// optional checksum manifest merged with the built-in checksums
+	ChecksumsPath string
+
+	// fail instead of warning when a download has no known SHA-256 checksum,
+	// a SHA-1 checksum is not enough
+	RequireChecksum bool
+
+	// directory where downloaded distributions are cached between builds,
+	// defaults to a gonative directory in the user's cache directory
+	CacheDir string
+
+	// don't keep downloaded distributions at all, tarballs are unpacked
+	// while they download
+	NoCache bool
+
+	// directory holding the distribution archives for an offline build,
+	// nothing is downloaded if it is set
+	DistDir string
+
+	// replace the target directory if it already exists instead of failing,
+	// as long as it is a Go installation
+	Force bool
+
+	// base URL of a mirror of the Go downloads to use instead of the
+	// official download site
+	Mirror string
+
+	// directory to keep scratch files like unpacked distributions in while
+	// building, a directory in the system's temp directory by default. Each
+	// build uses a new directory inside of it that is removed afterwards
+	// unless KeepWork is set.
+	WorkDir  string
+	KeepWork bool
+
+	// how long a download may wait for a connection or data before the
+	// attempt fails, and how many times failed downloads are retried
+	Timeout time.Duration
+	Retries int
+
+	// platforms to add to the existing gonative build at TargetPath without
+	// building Go again. Platforms is ignored if they are set.
+	AddPlatforms []Platform
+
+	// GOROOT of the Go installation to bootstrap Go 1.5 and later with.
+	// If it is empty, a local Go installation that is new enough is used,
+	// or one is downloaded.
+	BootstrapPath string
+
+	// C toolchains to build for platforms with cgo, and whether to use zig
+	// cc for the platforms that have none
+	Toolchains map[Platform]*crossToolchain
+	Zig        bool
 }
 
 func main() {
@@ -65,12 +128,36 @@ func main() {
 			Usage: "build a go installation with native stdlib packages",
 			Flags: []cli.Flag{
 				cli.StringFlag{"version", "1.5.2", "version of Go to build", "", nil},
-				cli.StringFlag{"src", "", "path to go source, empty string means to fetch from internet", "", nil},
+				cli.StringFlag{"src", "", "path to go source directory or archive, empty string means to fetch from internet or -dist-dir", "", nil},
 				cli.StringFlag{"target", "go", "target directory in which to build Go", "", nil},
+				cli.BoolFlag{"force", "replace the target directory if it already exists and is a Go installation", "", nil},
+				cli.StringFlag{"checksums", "", "path to a checksum manifest (go.dev/dl JSON or sha256sum output) to verify downloads with", "", nil},
+				cli.BoolFlag{"require-checksum", "refuse to use downloads that have no known SHA-256 checksum (SHA-1 checksums don't count)", "", nil},
+				cli.StringFlag{"cache-dir", "", "directory to cache downloaded distributions in, default is a gonative directory in the user cache directory", "", nil},
+				cli.BoolFlag{"no-cache", "don't keep downloaded distributions, unpack tarballs while they download", "", nil},
+				cli.StringFlag{"dist-dir", "", "directory with the distribution archives (.tar.gz, .tar.xz, .tar.zst, .tar.bz2, .tar or .zip) to build from instead of downloading them", "", nil},
+				cli.StringFlag{"mirror", "", "base URL of a mirror to download Go distributions from", "GONATIVE_MIRROR", nil},
+				cli.StringFlag{"work-dir", "", "directory for scratch files while building, default is the system temp directory", "", nil},
+				cli.BoolFlag{"keep-work", "don't remove the scratch files of the build, e.g. to debug a failed build", "", nil},
+				cli.DurationFlag{"timeout", defaultTimeout, "how long a download may stall before it is retried", "", nil},
+				cli.IntFlag{"retries", 5, "number of times to retry failed downloads", "", nil},
 				cli.StringFlag{"platforms", "", "space separated list of platforms to build, default is 'darwin_amd64 freebsd_amd64 linux_386 linux_amd64 windows_386 windows_amd64'", "", nil},
+				cli.StringFlag{"bootstrap", "", "GOROOT of the Go to build Go 1.5 and later with, default is the oldest local Go that is new enough or a downloaded one", "GOROOT_BOOTSTRAP", nil},
+				cli.StringFlag{"toolchains", "", "path to a JSON file with the C toolchain (cc, cxx, cflags, ldflags, sysroot or preset) to build for each platform with cgo", "", nil},
+				cli.BoolFlag{"zig", "use zig cc as the C toolchain for platforms without one", "", nil},
+				cli.StringFlag{"add-platforms", "", "space separated list of platforms to add to an existing build in the target directory, without building Go again", "", nil},
 			},
 			Action: buildCmd,
 		},
+		cli.Command{
+			Name:  "exec",
+			Usage: "run a command with the environment to build for a platform, e.g. gonative exec -platform=linux_amd64 -- go build ./...",
+			Flags: []cli.Flag{
+				cli.StringFlag{"target", "go", "directory of the Go built by gonative build", "", nil},
+				cli.StringFlag{"platform", "", "platform to build for, like linux_amd64", "", nil},
+			},
+			Action: execCmd,
+		},
 	}
 	axiom.WrapApp(app, axiom.NewLogged())
 	app.Commands = append(app.Commands, []cli.Command{
@@ -90,87 +177,326 @@ func buildCmd(c *cli.Context) {
 		}
 	}
 
+	version, err := ParseGoVersion(c.String("version"))
+	if err != nil {
+		exit(err)
+	}
+
 	opts := &Options{
-		Version:    c.String("version"),
-		SrcPath:    c.String("src"),
-		TargetPath: c.String("target"),
+		Version:         version,
+		SrcPath:         c.String("src"),
+		TargetPath:      c.String("target"),
+		Force:           c.Bool("force"),
+		ChecksumsPath:   c.String("checksums"),
+		RequireChecksum: c.Bool("require-checksum"),
+		CacheDir:        c.String("cache-dir"),
+		NoCache:         c.Bool("no-cache"),
+		DistDir:         c.String("dist-dir"),
+		Mirror:          c.String("mirror"),
+		WorkDir:         c.String("work-dir"),
+		KeepWork:        c.Bool("keep-work"),
+		Timeout:         c.Duration("timeout"),
+		Retries:         c.Int("retries"),
+		BootstrapPath:   c.String("bootstrap"),
+		Zig:             c.Bool("zig"),
+	}
+
+	if toolchains := c.String("toolchains"); toolchains != "" {
+		if opts.Toolchains, err = LoadToolchains(toolchains); err != nil {
+			exit(err)
+		}
 	}
 
 	platforms := c.String("platforms")
 	if platforms == "" {
 		opts.Platforms = defaultPlatforms
-	} else {
-		opts.Platforms = make([]Platform, 0)
-		for _, pString := range strings.Split(platforms, " ") {
-			parts := strings.Split(pString, "_")
-			if len(parts) != 2 {
-				exit(fmt.Errorf("Invalid platform string: %v", pString))
-			}
-			opts.Platforms = append(opts.Platforms, Platform{parts[0], parts[1]})
+	} else if opts.Platforms, err = parsePlatforms(platforms); err != nil {
+		exit(err)
+	}
+
+	if addPlatforms := c.String("add-platforms"); addPlatforms != "" {
+		if opts.AddPlatforms, err = parsePlatforms(addPlatforms); err != nil {
+			exit(err)
 		}
+		// add to whatever version the existing build is unless told otherwise
+		if !c.IsSet("version") {
+			opts.Version = GoVersion{}
+		}
+	}
+
+	// stop the build and clean up on ctrl-c, and right away on the second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		Log.Warn("interrupted, cleaning up", "signal", sig)
+		cancel()
+		<-signals
+		os.Exit(1)
+	}()
+
+	exit(Build(ctx, opts))
+}
+
+func execCmd(c *cli.Context) {
+	exit := func(err error) {
+		log.Crit("command failed", "err", err)
+		os.Exit(1)
 	}
 
-	exit(Build(opts))
+	args := c.Args()
+	if len(args) == 0 {
+		exit(fmt.Errorf("No command to run, e.g. gonative exec -platform=linux_amd64 -- go build ./..."))
+	}
+	if c.String("platform") == "" {
+		exit(fmt.Errorf("No platform to build for, set one with -platform"))
+	}
+	p, err := parsePlatform(c.String("platform"))
+	if err != nil {
+		exit(err)
+	}
+	goRoot, err := filepath.Abs(c.String("target"))
+	if err != nil {
+		exit(err)
+	}
+
+	code, err := runForPlatform(goRoot, p, args)
+	if err != nil {
+		exit(err)
+	}
+	os.Exit(code)
 }
 
-func Build(opts *Options) error {
+// parsePlatforms parses a space separated list of platforms
+func parsePlatforms(s string) ([]Platform, error) {
+	platforms := make([]Platform, 0)
+	for _, pString := range strings.Split(s, " ") {
+		p, err := parsePlatform(pString)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// Build builds Go with native stdlib packages as described by opts. If ctx
+// is canceled, it stops all downloads and builds, removes their temporary
+// files and returns an error.
+func Build(ctx context.Context, opts *Options) (err error) {
 	// normalize paths
 	targetPath, err := filepath.Abs(opts.TargetPath)
 	if err != nil {
 		return err
 	}
 
+	// add to an existing build instead of building Go again if we can
+	existing, err := incrementalBuild(opts, targetPath)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if len(opts.Platforms) == 0 {
+			Log.Info("all platforms are already built", "target", targetPath, "platforms", existing.Platforms)
+			return nil
+		}
+		// the existing build stands in for the source, make.bash isn't run
+		opts.SrcPath = targetPath
+	} else if err := checkTarget(targetPath, opts.Force); err != nil {
+		return err
+	}
+
+	// pick the C toolchains of the new platforms and keep those of the
+	// existing ones
+	if err := resolveToolchains(opts, opts.Platforms); err != nil {
+		return err
+	}
+	if existing != nil {
+		for _, p := range existing.platforms() {
+			if tc := existing.toolchain(p); tc != nil && opts.Toolchains[p] == nil {
+				opts.Toolchains[p] = tc
+			}
+		}
+	}
+
+	if opts.ChecksumsPath != "" {
+		if err := LoadChecksums(opts.ChecksumsPath); err != nil {
+			return err
+		}
+	}
+
+	// only make.bash and dist need a bootstrap toolchain
+	needsBootstrap := existing == nil || shipsPkg(opts.Version)
+
+	if opts.DistDir != "" {
+		if err := checkDistDir(ctx, opts, needsBootstrap); err != nil {
+			return err
+		}
+	}
+
 	src := opts.SrcPath
-	if src == "" {
+	if src == "" && opts.DistDir != "" {
+		src = "(from " + opts.DistDir + ")"
+	} else if src == "" && opts.Mirror != "" {
+		src = "(from " + opts.Mirror + ")"
+	} else if src == "" {
 		src = "(from internet)"
 	}
-	Log.Info("building go", "version", opts.Version, "src", src, "target", targetPath, "platforms", opts.Platforms)
+	if existing != nil {
+		Log.Info("adding platforms to existing build", "version", opts.Version, "target", targetPath, "platforms", opts.Platforms)
+	} else {
+		Log.Info("building go", "version", opts.Version, "src", src, "target", targetPath, "platforms", opts.Platforms)
+	}
+
+	// keep all scratch files of this build in a directory of its own
+	workDir, err := makeWorkDir(opts.WorkDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if opts.KeepWork {
+			Log.Info("keeping work directory", "path", workDir)
+		} else {
+			os.RemoveAll(workDir)
+		}
+	}()
+	opts.WorkDir = workDir
+
+	// build in a staging directory that is moved to the target at the end
+	staging, buildPath, err := stageTarget(targetPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && opts.KeepWork {
+			Log.Info("keeping failed build", "path", buildPath)
+		} else {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	// report download and copy progress while we build
+	progressDisplay = startProgress()
+	defer progressDisplay.Stop()
+
+	// stop whatever is still running when the build fails or is canceled
+	// and wait for the platform goroutines to clean up after themselves
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+		if err != nil && parent.Err() != nil {
+			err = fmt.Errorf("Build canceled: %v", parent.Err())
+		}
+	}()
 
 	// tells the platform goroutines that the target path is ready
 	targetReady := make(chan struct{})
 
-	// platform gorouintes can report an error here
-	errors := make(chan error, len(opts.Platforms))
+	// platform goroutines report how they went here
+	results := make(chan platformResult, len(opts.Platforms))
 
 	// need to wait for each platform to finish
-	var wg sync.WaitGroup
 	wg.Add(len(opts.Platforms))
 
 	// run all platform fetch/copies in parallel
 	for _, p := range opts.Platforms {
-		go getPlatform(p, targetPath, opts.Version, targetReady, errors, &wg)
+		go getPlatform(ctx, p, buildPath, opts, targetReady, results, &wg)
 	}
 
+	// however the build ends, wait for the platforms and summarize how
+	// every download was verified and how each of them went
+	var downloads []Verification
+	summarized := false
+	summarize := func() buildError {
+		summarized = true
+		wg.Wait()
+		close(results)
+		platformResults, failed, platformDownloads := collectResults(opts.Platforms, results)
+		logVerifications(append(downloads, platformDownloads...))
+		progressDisplay.Stop()
+		printStatus(os.Stderr, platformResults)
+		return failed
+	}
+	defer func() {
+		if summarized {
+			return
+		}
+		// the build failed before the platforms were done, stop them
+		cancel()
+		failed := summarize()
+		if stepErr, ok := err.(*platformError); ok {
+			errs := buildError{stepErr}
+			for _, e := range failed {
+				// those are only canceled because of the failed step
+				if e.Phase != "wait for target" {
+					errs = append(errs, e)
+				}
+			}
+			err = errs
+		}
+	}()
+
 	// if no source path specified, fetch source from the internet
 	if opts.SrcPath == "" {
-		srcPath, err := srcPlatform.Download(opts.Version)
+		srcPath, v, err := srcPlatform.Download(ctx, opts, nil)
 		if err != nil {
-			return err
+			return &platformError{srcPlatform, "download", err}
+		}
+		downloads = append(downloads, v)
+		opts.SrcPath = filepath.Join(srcPath, "go")
+	} else if fi, err := os.Stat(opts.SrcPath); err == nil && !fi.IsDir() {
+		// the source is an archive, not a directory
+		srcPath, err := unpackLocalArchive(ctx, opts.SrcPath, opts.WorkDir)
+		if err != nil {
+			return &platformError{srcPlatform, "unpack", err}
 		}
-		defer os.RemoveAll(srcPath)
 		opts.SrcPath = filepath.Join(srcPath, "go")
 	}
 
-	// copy the source to the target directory
-	err = CopyAll(targetPath, opts.SrcPath)
+	// copy the source to the build directory
+	err = CopyAll(buildPath, opts.SrcPath)
 	if err != nil {
-		return err
+		return &platformError{srcPlatform, "copy", err}
 	}
 
-	// build Go for the host platform
-	err = makeDotBash(targetPath)
-	Log.Debug("make.bash", "err", err)
-	if err != nil {
-		return err
+	// find a Go to build Go with
+	var boot *bootstrap
+	if needsBootstrap {
+		var bootDownloads []Verification
+		boot, bootDownloads, err = findBootstrap(ctx, opts)
+		downloads = append(downloads, bootDownloads...)
+		if err != nil {
+			return &platformError{hostPlatform(), "bootstrap toolchain", fmt.Errorf("No bootstrap toolchain for Go %s: %v", opts.Version, err)}
+		}
+		if boot != nil {
+			Log.Info("using bootstrap toolchain", "path", boot.GoRoot, "version", boot.Version, "from", boot.Origin)
+		}
 	}
 
-	// bootstrap compilers for all target platforms
-	Log.Info("boostraping go compilers")
-	for _, p := range opts.Platforms {
-		err = distBootstrap(targetPath, p)
-		Log.Debug("bootstrap compiler", "plat", p, "err", err)
+	// build Go for the host platform, unless it already was
+	if existing == nil {
+		err = makeDotBash(ctx, buildPath, targetPath, boot)
+		Log.Debug("make.bash", "err", err)
 		if err != nil {
-			return err
+			return &platformError{hostPlatform(), "make.bash", err}
+		}
+	}
+
+	// bootstrap compilers for all target platforms, newer versions build
+	// for every platform with the host toolchain
+	if shipsPkg(opts.Version) {
+		Log.Info("boostraping go compilers")
+		for _, p := range opts.Platforms {
+			err = distBootstrap(ctx, buildPath, targetPath, p, boot)
+			Log.Debug("bootstrap compiler", "plat", p, "err", err)
+			if err != nil {
+				return &platformError{p, "bootstrap compiler", err}
+			}
 		}
 	}
 
@@ -178,51 +504,119 @@ func Build(opts *Options) error {
 	close(targetReady)
 
 	// wait for all platforms to finish
-	wg.Wait()
+	if failed := summarize(); len(failed) > 0 {
+		return failed
+	}
 
-	// return error if a platform failed
-	select {
-	case err := <-errors:
+	// record what was built so platforms can be added to it later
+	built := opts.Platforms
+	if existing != nil {
+		built = append(existing.platforms(), built...)
+	}
+	if err := writeManifest(buildPath, opts.Version, built, opts.Toolchains); err != nil {
+		return err
+	}
+	if err := commitTarget(staging, buildPath, targetPath); err != nil {
 		return err
-	default:
-		Log.Info("successfuly built Go", "path", targetPath)
-		return nil
 	}
+	Log.Info("successfuly built Go", "path", targetPath)
+	return nil
 }
 
-func getPlatform(p Platform, targetPath, version string, targetReady chan struct{}, errors chan error, wg *sync.WaitGroup) {
+// collectResults reads the result of every platform from results in the
+// order the platforms were given, along with their failures and the
+// downloads that got far enough to be verified
+func collectResults(platforms []Platform, results chan platformResult) ([]platformResult, buildError, []Verification) {
+	byPlatform := make(map[Platform]platformResult)
+	for r := range results {
+		byPlatform[r.Platform] = r
+	}
+	var failed buildError
+	var downloads []Verification
+	platformResults := make([]platformResult, 0, len(platforms))
+	for _, p := range platforms {
+		r := byPlatform[p]
+		platformResults = append(platformResults, r)
+		if r.Err != nil {
+			failed = append(failed, r.Err)
+		}
+		if r.Verification.URL != "" && (r.Err == nil || r.Err.Phase != "download") {
+			downloads = append(downloads, r.Verification)
+		}
+	}
+	return platformResults, failed, downloads
+}
+
+// getPlatform gets the cgo-enabled standard library for p into the target
+// once it is ready: copied from the binary distribution for versions that
+// ship it, built otherwise. It sends how that went to results. It gives up
+// once ctx is done.
+func getPlatform(ctx context.Context, p Platform, targetPath string, opts *Options, targetReady chan struct{}, results chan platformResult, wg *sync.WaitGroup) {
 	lg := Log.New("plat", p)
 	defer wg.Done()
 
-	// download the binary distribution
-	path, err := p.Download(version)
+	start := time.Now()
+	result := platformResult{Platform: p}
+	defer func() {
+		result.Duration = time.Since(start)
+		results <- result
+	}()
+
+	var phase string
+	var err error
+	if shipsPkg(opts.Version) {
+		phase, err = copyPlatform(ctx, lg, p, targetPath, opts, targetReady, &result.Verification)
+	} else {
+		phase, err = buildPlatform(ctx, lg, p, targetPath, opts.Toolchains[p], targetReady)
+	}
 	if err != nil {
-		errors <- err
-		return
+		lg.Error("platform failed", "phase", phase, "err", err)
+		result.Err = &platformError{p, phase, err}
+	}
+}
+
+// copyPlatform downloads the binary distribution for p and copies its
+// packages and generated runtime files into the target. It returns what it
+// was doing if it fails.
+func copyPlatform(ctx context.Context, lg log.Logger, p Platform, targetPath string, opts *Options, targetReady chan struct{}, v *Verification) (phase string, err error) {
+	version := opts.Version
+
+	// download the binary distribution, but only the parts we copy
+	path, dl, err := p.Download(ctx, opts, p.distFilter(version))
+	*v = dl
+	if err != nil {
+		return "download", err
+	}
+	if !opts.KeepWork {
+		defer os.RemoveAll(path)
 	}
-	defer os.RemoveAll(path)
 
-	// wait for target directory to be ready
-	<-targetReady
+	if err := waitTarget(ctx, targetReady); err != nil {
+		return "wait for target", err
+	}
 
-	// copy over the packages
+	// copy over the packages, replacing any built by make.bash or dist
 	targetPkgPath := filepath.Join(targetPath, "pkg", p.String())
 	srcPkgPath := filepath.Join(path, "go", "pkg", p.String())
-	err = CopyAll(targetPkgPath, srcPkgPath)
+	err = os.RemoveAll(targetPkgPath)
+	if err == nil {
+		err = CopyAll(targetPkgPath, srcPkgPath)
+	}
 	if err != nil {
-		errors <- err
-		return
+		return "copy packages", err
 	}
 
 	// copy over the auto-generated z_ files
-	srcZPath := filepath.Join(path, "go", "src", "runtime", "z*_"+p.String())
-	targetZPath := filepath.Join(targetPath, "src", "runtime")
-	if version < "1.4" {
-		srcZPath = filepath.Join(path, "go", "src", "pkg", "runtime", "z*_"+p.String())
-		targetZPath = filepath.Join(targetPath, "src", "pkg", "runtime")
+	srcZPath := filepath.Join(path, "go", runtimeDir(version), p.zFilePattern())
+	targetZPath := filepath.Join(targetPath, runtimeDir(version))
+	zfiles, err := CopyGlob(targetZPath, srcZPath)
+	lg.Debug("copy zfiles", "dst", targetZPath, "src", srcZPath, "files", zfiles, "err", err)
+	if err != nil {
+		return "copy runtime files", err
+	}
+	if len(zfiles) == 0 && version.Less(goVersion15) {
+		return "copy runtime files", fmt.Errorf("The %s distribution has no generated runtime files matching %s", p.String(), srcZPath)
 	}
-	lg.Debug("copy zfile", "dst", targetZPath, "src", srcZPath, "err", err)
-	CopyFile(targetZPath, srcZPath)
 
 	// change the mod times
 	now := time.Now()
@@ -232,14 +626,74 @@ func getPlatform(p Platform, targetPath, version string, targetReady chan struct
 	})
 	lg.Debug("set modtimes", "err", err)
 	if err != nil {
-		errors <- err
-		return
+		return "set modtimes", err
 	}
+	return "", nil
+}
+
+// buildPlatform builds the standard library for p with cgo and the C toolchain
+// tc into the build cache once the target is ready. It returns what it was
+// doing if it fails.
+func buildPlatform(ctx context.Context, lg log.Logger, p Platform, targetPath string, tc *crossToolchain, targetReady chan struct{}) (phase string, err error) {
+	if err := waitTarget(ctx, targetReady); err != nil {
+		return "wait for target", err
+	}
+	err = buildStd(ctx, targetPath, p, tc)
+	lg.Debug("build std", "err", err)
+	if err != nil {
+		return "build std", err
+	}
+	return "", nil
+}
+
+// waitTarget waits for the target directory to be ready
+func waitTarget(ctx context.Context, targetReady chan struct{}) error {
+	select {
+	case <-targetReady:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// makeWorkDir creates a new directory for the scratch files of a build in
+// dir, or in the system temp directory if dir is empty
+func makeWorkDir(dir string) (string, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	return ioutil.TempDir(dir, "gonative-")
+}
+
+// runtimeDir returns where the runtime sources are in a GOROOT for version
+func runtimeDir(version GoVersion) string {
+	if version.Less(goVersion14) {
+		return filepath.Join("src", "pkg", "runtime")
+	}
+	return filepath.Join("src", "runtime")
+}
+
+// distFilter selects the parts of the platform's binary distribution that
+// copyPlatform copies: the packages and the generated runtime files
+func (p *Platform) distFilter(version GoVersion) *extractFilter {
+	return &extractFilter{Include: []string{
+		"go/pkg/" + p.String(),
+		path.Join("go", filepath.ToSlash(runtimeDir(version)), p.zFilePattern()),
+	}}
+}
+
+// zFilePattern matches the names of the runtime files generated for the
+// platform, like zsys_linux_amd64.s
+func (p *Platform) zFilePattern() string {
+	return "z*_" + p.String() + ".*"
 }
 
 // runs make.[bash|bat] in the source directory to build all of the compilers
-// and standard library
-func makeDotBash(goRoot string) (err error) {
+// and standard library. goRootFinal is where the build will be moved to, boot
+// the toolchain to build it with.
+func makeDotBash(ctx context.Context, goRoot, goRootFinal string, boot *bootstrap) (err error) {
 	scriptName := "make.bash"
 	if runtime.GOOS == "windows" {
 		scriptName = "make.bat"
@@ -251,24 +705,21 @@ func makeDotBash(goRoot string) (err error) {
 	}
 	scriptDir := filepath.Dir(scriptPath)
 
-	cmd := exec.Cmd{
-		Path:   scriptPath,
-		Args:   []string{scriptPath},
-		Env:    os.Environ(),
-		Dir:    scriptDir,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	}
-
+	cmd := groupCommand(ctx, scriptPath)
+	cmd.Env = append(os.Environ(), "GOROOT_FINAL="+goRootFinal)
+	cmd.Env = append(cmd.Env, boot.env()...)
+	cmd.Dir = scriptDir
+	cmd.Stdout = progressDisplay.Writer(os.Stdout)
+	cmd.Stderr = progressDisplay.Writer(os.Stderr)
 	return cmd.Run()
 }
 
 // runs dist bootrap to build the compilers for a target platform
-func distBootstrap(goRoot string, p Platform) (err error) {
+func distBootstrap(ctx context.Context, goRoot, goRootFinal string, p Platform, boot *bootstrap) (err error) {
 	// the dist tool gets put in the pkg/tool/{host_platform} directory after we've built
 	// the compilers/stdlib for the host platform
-	hostPlatform := Platform{runtime.GOOS, runtime.GOARCH}
-	scriptPath, err := filepath.Abs(filepath.Join(goRoot, "pkg", "tool", hostPlatform.String(), "dist"))
+	host := hostPlatform()
+	scriptPath, err := filepath.Abs(filepath.Join(goRoot, "pkg", "tool", host.String(), "dist"))
 	if err != nil {
 		return
 	}
@@ -279,17 +730,15 @@ func distBootstrap(goRoot string, p Platform) (err error) {
 		return
 	}
 
-	bootstrapCmd := exec.Cmd{
-		Path: scriptPath,
-		Args: []string{scriptPath, "bootstrap", "-v"},
-		Env: append(os.Environ(),
-			"GOOS="+p.OS,
-			"GOARCH="+p.Arch,
-			"GOROOT="+goRoot),
-		Dir:    scriptDir,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	}
-
+	bootstrapCmd := groupCommand(ctx, scriptPath, "bootstrap", "-v")
+	bootstrapCmd.Env = append(os.Environ(),
+		"GOOS="+p.OS,
+		"GOARCH="+p.Arch,
+		"GOROOT="+goRoot,
+		"GOROOT_FINAL="+goRootFinal)
+	bootstrapCmd.Env = append(bootstrapCmd.Env, boot.env()...)
+	bootstrapCmd.Dir = scriptDir
+	bootstrapCmd.Stdout = progressDisplay.Writer(os.Stdout)
+	bootstrapCmd.Stderr = progressDisplay.Writer(os.Stderr)
 	return bootstrapCmd.Run()
 }
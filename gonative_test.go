@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeDist writes a fake binary distribution of version for p into distDir
+func writeDist(t *testing.T, distDir string, version GoVersion, p Platform, hdrs ...*tar.Header) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(makeTar(t, hdrs...))
+	zw.Close()
+	name := filepath.Base(p.distURL(version, ""))
+	if err := ioutil.WriteFile(filepath.Join(distDir, name), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCopyPlatform(t *testing.T, version string, hdrs ...*tar.Header) (targetPath, phase string, err error) {
+	tmp, err := ioutil.TempDir("", "gonative-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	distDir, workDir, targetPath := filepath.Join(tmp, "dist"), filepath.Join(tmp, "work"), filepath.Join(tmp, "go")
+	// the target as make.bash leaves it
+	for _, dir := range []string{distDir, workDir, filepath.Join(targetPath, "src", "runtime"), filepath.Join(targetPath, "pkg")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// versions gonative has no checksums for, so they are only warned about
+	opts := &Options{Version: mustParseGoVersion(version), DistDir: distDir, WorkDir: workDir}
+	p := Platform{"linux", "amd64"}
+	writeDist(t, distDir, opts.Version, p, hdrs...)
+
+	ready := make(chan struct{})
+	close(ready)
+	var v Verification
+	phase, err = copyPlatform(context.Background(), Log, p, targetPath, opts, ready, &v)
+	return targetPath, phase, err
+}
+
+func TestCopyPlatform(t *testing.T) {
+	targetPath, phase, err := testCopyPlatform(t, "1.4.99",
+		file("go/pkg/linux_amd64/runtime.a", "runtime"),
+		file("go/pkg/linux_amd64/net.a", "net"),
+		file("go/pkg/darwin_amd64/runtime.a", "darwin runtime"),
+		file("go/src/runtime/zasm_linux_amd64.h", "asm"),
+		file("go/src/runtime/zsys_linux_amd64.s", "sys"),
+		file("go/src/runtime/zsys_darwin_amd64.s", "darwin sys"),
+		file("go/src/runtime/proc.c", "proc"),
+	)
+	defer os.RemoveAll(filepath.Dir(targetPath))
+	if err != nil {
+		t.Fatalf("%s: %v", phase, err)
+	}
+
+	got := dirNames(t, filepath.Join(targetPath, "src", "runtime"))
+	if want := []string{"zasm_linux_amd64.h", "zsys_linux_amd64.s"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copied runtime files %v, want %v", got, want)
+	}
+	got = dirNames(t, filepath.Join(targetPath, "pkg"))
+	if want := []string{"linux_amd64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copied packages for %v, want %v", got, want)
+	}
+	if data := readTestFile(t, filepath.Join(targetPath, "pkg", "linux_amd64", "net.a")); data != "net" {
+		t.Errorf("copied package has %q, want %q", data, "net")
+	}
+}
+
+func TestCopyPlatformMissingRuntimeFiles(t *testing.T) {
+	// before Go 1.5 the packages are useless without the generated files
+	targetPath, phase, err := testCopyPlatform(t, "1.4.99",
+		file("go/pkg/linux_amd64/runtime.a", "runtime"),
+		file("go/src/runtime/proc.c", "proc"),
+	)
+	os.RemoveAll(filepath.Dir(targetPath))
+	if err == nil || phase != "copy runtime files" {
+		t.Errorf("got %v in phase %q, want a missing runtime files error", err, phase)
+	}
+
+	// later versions generate them while building
+	targetPath, phase, err = testCopyPlatform(t, "1.5.99",
+		file("go/pkg/linux_amd64/runtime.a", "runtime"),
+		file("go/src/runtime/proc.go", "proc"),
+	)
+	os.RemoveAll(filepath.Dir(targetPath))
+	if err != nil {
+		t.Errorf("%s: %v", phase, err)
+	}
+}
+
+func TestDownloadDistDirFormats(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gonative-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	distDir, workDir := filepath.Join(tmp, "dist"), filepath.Join(tmp, "work")
+	for _, dir := range []string{distDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a plain tarball where the download site has a .tar.gz
+	opts := &Options{Version: mustParseGoVersion("1.4.99"), DistDir: distDir, WorkDir: workDir}
+	p := Platform{"linux", "amd64"}
+	data := makeTar(t, file("go/VERSION", "go1.4.99"))
+	if err := ioutil.WriteFile(filepath.Join(distDir, "go1.4.99.linux-amd64.tar"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !hasDistFile(distDir, p, opts.Version) {
+		t.Fatal("distribution directory has no archive for linux_amd64")
+	}
+	dir, v, err := p.Download(context.Background(), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(dir, "go", "VERSION")); got != "go1.4.99" {
+		t.Errorf("VERSION has %q, want %q", got, "go1.4.99")
+	}
+	if path.Base(v.URL) != "go1.4.99.linux-amd64.tar" {
+		t.Errorf("downloaded %s, want the plain tarball", v.URL)
+	}
+}
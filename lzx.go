@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// LZX decompression for cabinet folders, which is what the Go installers use.
+// An LZX stream is a sequence of blocks, each either stored or LZ77 coded
+// with canonical Huffman trees that are themselves delta coded against the
+// trees of the previous block. The output is produced in frames of 32k, one
+// per cabinet data block, and the input is read as 16-bit little endian
+// words, most significant bit first.
+
+const (
+	lzxFrameSize     = 32768
+	lzxMinWindowBits = 15
+	lzxMaxWindowBits = 21
+	lzxNumChars      = 256
+	lzxPretreeSize   = 20
+	lzxAlignedSize   = 8
+	lzxLengthSize    = 249
+	lzxMaxCodeLen    = 16
+
+	lzxBlockVerbatim     = 1
+	lzxBlockAligned      = 2
+	lzxBlockUncompressed = 3
+
+	// how many zero bytes past the end of the input the bit reader makes up
+	// to fill its last lookahead
+	lzxMaxPadding = 4
+)
+
+// how many match position slots there are for each window size
+var lzxPositionSlots = [...]int{30, 32, 34, 36, 38, 42, 50}
+
+// the number of extra bits after each position slot, and the smallest
+// position it stands for
+var lzxExtraBits, lzxPositionBase [51]int
+
+func init() {
+	for i, j := 0, 0; i < len(lzxExtraBits); i += 2 {
+		lzxExtraBits[i] = j
+		if i+1 < len(lzxExtraBits) {
+			lzxExtraBits[i+1] = j
+		}
+		if i != 0 && j < 17 {
+			j++
+		}
+	}
+	for i, j := 0, 0; i < len(lzxPositionBase); i++ {
+		lzxPositionBase[i] = j
+		j += 1 << uint(lzxExtraBits[i])
+	}
+}
+
+// lzxDecoder decompresses the LZX data of one cabinet folder read from in
+type lzxDecoder struct {
+	in  io.ByteReader
+	err error
+
+	// bit buffer, the next bit is the most significant one
+	bits    uint32
+	nbits   uint
+	padding int
+
+	window   []byte
+	wrapped  bool
+	pos      int
+	framePos int
+	slots    int
+
+	// the three most recent match offsets
+	r0, r1, r2 int
+
+	blockType      int
+	blockLength    int
+	blockRemaining int
+
+	mainLens   []byte
+	lengthLens []byte
+	main       lzxTree
+	length     lzxTree
+	aligned    lzxTree
+
+	// x86 call translation
+	headerRead   bool
+	intelStarted bool
+	intelSize    int32
+	intelPos     int32
+	frames       int
+}
+
+func newLZXDecoder(in io.ByteReader, windowBits uint) (*lzxDecoder, error) {
+	if windowBits < lzxMinWindowBits || windowBits > lzxMaxWindowBits {
+		return nil, fmt.Errorf("bad LZX window size: 2^%d", windowBits)
+	}
+	slots := lzxPositionSlots[windowBits-lzxMinWindowBits]
+	return &lzxDecoder{
+		in:         in,
+		window:     make([]byte, 1<<windowBits),
+		slots:      slots,
+		r0:         1,
+		r1:         1,
+		r2:         1,
+		mainLens:   make([]byte, lzxNumChars+slots*8),
+		lengthLens: make([]byte, lzxLengthSize),
+	}, nil
+}
+
+func (d *lzxDecoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("bad LZX data: "+format, args...)
+	}
+}
+
+// need makes sure there are at least n <= 17 bits in the bit buffer
+func (d *lzxDecoder) need(n uint) {
+	for d.nbits < n {
+		var word uint32
+		for i := uint(0); i < 2; i++ {
+			b, err := d.in.ReadByte()
+			if err == io.EOF && d.padding < lzxMaxPadding {
+				d.padding++
+			} else if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				if d.err == nil {
+					d.err = err
+				}
+				// keep going with zeros, the caller checks d.err
+			}
+			word |= uint32(b) << (8 * i)
+		}
+		d.bits |= word << (16 - d.nbits)
+		d.nbits += 16
+	}
+}
+
+func (d *lzxDecoder) getBits(n uint) int {
+	if n == 0 {
+		return 0
+	}
+	d.need(n)
+	v := d.bits >> (32 - n)
+	d.bits <<= n
+	d.nbits -= n
+	return int(v)
+}
+
+// lzxTree decodes the symbols of a canonical Huffman code. Its table is
+// indexed by the next maxLen bits of input and holds the symbol shifted left
+// by 5 along with its code length, which is 0 for unused codes.
+type lzxTree struct {
+	table  []uint16
+	maxLen uint
+}
+
+// build sets up t for the code lengths in lens. Codes may be incomplete, but
+// not oversubscribed. All lengths being zero makes an empty tree.
+func (t *lzxTree) build(lens []byte) error {
+	var count [lzxMaxCodeLen + 1]int
+	maxLen := uint(0)
+	for _, l := range lens {
+		if l > lzxMaxCodeLen {
+			return fmt.Errorf("bad LZX code length %d", l)
+		}
+		count[l]++
+		if uint(l) > maxLen {
+			maxLen = uint(l)
+		}
+	}
+	t.maxLen = maxLen
+	size := 1 << maxLen
+	if cap(t.table) < size {
+		t.table = make([]uint16, size)
+	}
+	t.table = t.table[:size]
+	for i := range t.table {
+		t.table[i] = 0
+	}
+	if maxLen == 0 {
+		return nil
+	}
+
+	var next [lzxMaxCodeLen + 2]int
+	code := 0
+	for l := uint(1); l <= maxLen; l++ {
+		code = (code + count[l-1]) << 1
+		if l == 1 {
+			code = 0
+		}
+		next[l] = code
+	}
+	for sym, l := range lens {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+		if code >= 1<<l {
+			return fmt.Errorf("bad LZX Huffman tree")
+		}
+		shift := maxLen - uint(l)
+		for i := code << shift; i < (code+1)<<shift; i++ {
+			t.table[i] = uint16(sym)<<5 | uint16(l)
+		}
+	}
+	return nil
+}
+
+func (d *lzxDecoder) decode(t *lzxTree) int {
+	if t.maxLen == 0 {
+		d.fail("symbol from an empty tree")
+		return 0
+	}
+	d.need(t.maxLen)
+	e := t.table[d.bits>>(32-t.maxLen)]
+	l := uint(e & 31)
+	if l == 0 {
+		d.fail("invalid Huffman code")
+		return 0
+	}
+	d.bits <<= l
+	d.nbits -= l
+	return int(e >> 5)
+}
+
+// readLengths updates lens[first:last] with delta coded code lengths, which
+// come with a pretree of their own
+func (d *lzxDecoder) readLengths(lens []byte, first, last int) {
+	var preLens [lzxPretreeSize]byte
+	for i := range preLens {
+		preLens[i] = byte(d.getBits(4))
+	}
+	var pre lzxTree
+	if err := pre.build(preLens[:]); err != nil {
+		d.fail("%v", err)
+		return
+	}
+	delta := func(x, z int) byte {
+		return byte((int(lens[x]) - z + 17) % 17)
+	}
+	for x := first; x < last && d.err == nil; {
+		z := d.decode(&pre)
+		run, zero := 1, false
+		switch z {
+		case 17:
+			run, zero = d.getBits(4)+4, true
+		case 18:
+			run, zero = d.getBits(5)+20, true
+		case 19:
+			run = d.getBits(1) + 4
+			if z = d.decode(&pre); z > 16 {
+				d.fail("bad pretree symbol %d", z)
+				return
+			}
+		}
+		if x+run > len(lens) {
+			d.fail("code lengths run past the tree")
+			return
+		}
+		l := byte(0)
+		if !zero {
+			l = delta(x, z)
+		}
+		for end := x + run; x < end; x++ {
+			lens[x] = l
+		}
+	}
+}
+
+func (d *lzxDecoder) readBlockHeader() {
+	// uncompressed blocks of odd length are padded to 16 bits
+	if d.blockType == lzxBlockUncompressed && d.blockLength&1 != 0 {
+		if _, err := d.in.ReadByte(); err != nil {
+			d.fail("missing padding")
+			return
+		}
+	}
+
+	d.blockType = d.getBits(3)
+	d.blockLength = d.getBits(16)<<8 | d.getBits(8)
+	d.blockRemaining = d.blockLength
+
+	switch d.blockType {
+	case lzxBlockAligned, lzxBlockVerbatim:
+		if d.blockType == lzxBlockAligned {
+			var lens [lzxAlignedSize]byte
+			for i := range lens {
+				lens[i] = byte(d.getBits(3))
+			}
+			if err := d.aligned.build(lens[:]); err != nil {
+				d.fail("%v", err)
+			}
+		}
+		d.readLengths(d.mainLens, 0, lzxNumChars)
+		d.readLengths(d.mainLens, lzxNumChars, len(d.mainLens))
+		if err := d.main.build(d.mainLens); err != nil {
+			d.fail("%v", err)
+		}
+		if d.mainLens[0xe8] != 0 {
+			d.intelStarted = true
+		}
+		d.readLengths(d.lengthLens, 0, lzxLengthSize)
+		if err := d.length.build(d.lengthLens); err != nil {
+			d.fail("%v", err)
+		}
+	case lzxBlockUncompressed:
+		d.intelStarted = true
+		// skip to the next 16-bit boundary, a whole word if already there
+		if d.nbits == 0 {
+			d.need(16)
+		}
+		d.bits, d.nbits = 0, 0
+		var buf [12]byte
+		for i := range buf {
+			b, err := d.in.ReadByte()
+			if err != nil {
+				d.fail("truncated uncompressed block")
+				return
+			}
+			buf[i] = b
+		}
+		d.r0 = int(binary.LittleEndian.Uint32(buf[0:]))
+		d.r1 = int(binary.LittleEndian.Uint32(buf[4:]))
+		d.r2 = int(binary.LittleEndian.Uint32(buf[8:]))
+	default:
+		d.fail("bad block type %d", d.blockType)
+	}
+}
+
+// frame decompresses the next size bytes of the folder
+func (d *lzxDecoder) frame(size int) ([]byte, error) {
+	if size <= 0 || size > lzxFrameSize {
+		return nil, fmt.Errorf("bad LZX frame size %d", size)
+	}
+	if !d.headerRead {
+		// the file size for x86 call translation, if it is used
+		if d.getBits(1) != 0 {
+			d.intelSize = int32(d.getBits(16)<<16 | d.getBits(16))
+		}
+		d.headerRead = true
+	}
+
+	end := d.framePos + size
+	if end > len(d.window) {
+		return nil, fmt.Errorf("bad LZX frame size %d", size)
+	}
+	for d.pos < end && d.err == nil {
+		if d.blockRemaining == 0 {
+			d.readBlockHeader()
+			if d.err != nil {
+				break
+			}
+			if d.blockRemaining == 0 {
+				d.fail("empty block")
+				break
+			}
+		}
+		run := d.blockRemaining
+		if run > end-d.pos {
+			run = end - d.pos
+		}
+		var n int
+		if d.blockType == lzxBlockUncompressed {
+			n = d.copyStored(run)
+		} else {
+			n = d.decodeRun(run)
+		}
+		// a match at the end of the frame may run into the next one
+		if n > d.blockRemaining {
+			d.fail("match runs past the end of the block")
+		}
+		d.blockRemaining -= n
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	// the next frame starts at a 16-bit boundary, the bit buffer may
+	// already hold its first word
+	k := d.nbits & 15
+	d.bits <<= k
+	d.nbits -= k
+
+	// the window keeps the untranslated data for later matches
+	out := append([]byte(nil), d.window[d.framePos:end]...)
+	if d.intelStarted && d.intelSize != 0 && d.frames < 32768 && size > 10 {
+		lzxTranslateE8(out, d.intelPos, d.intelSize)
+	}
+	if d.intelSize != 0 {
+		d.intelPos += int32(size)
+	}
+	d.frames++
+
+	d.framePos = end
+	if d.framePos == len(d.window) {
+		d.framePos = 0
+		d.wrapped = true
+	}
+	if d.pos == len(d.window) {
+		d.pos = 0
+	}
+	return out, nil
+}
+
+// copyStored copies n bytes of an uncompressed block into the window
+func (d *lzxDecoder) copyStored(n int) int {
+	for i := 0; i < n; i++ {
+		b, err := d.in.ReadByte()
+		if err != nil {
+			d.fail("truncated uncompressed block")
+			return i
+		}
+		d.window[d.pos] = b
+		d.pos++
+	}
+	return n
+}
+
+// decodeRun decodes at least n bytes of a verbatim or aligned block into the
+// window and returns how many it decoded
+func (d *lzxDecoder) decodeRun(n int) int {
+	start := d.pos
+	for d.pos-start < n && d.err == nil {
+		sym := d.decode(&d.main)
+		if sym < lzxNumChars {
+			d.window[d.pos] = byte(sym)
+			d.pos++
+			continue
+		}
+
+		sym -= lzxNumChars
+		length := sym & 7
+		if length == 7 {
+			length += d.decode(&d.length)
+		}
+		length += 2
+
+		var offset int
+		switch slot := sym >> 3; slot {
+		case 0:
+			offset = d.r0
+		case 1:
+			offset = d.r1
+			d.r1, d.r0 = d.r0, offset
+		case 2:
+			offset = d.r2
+			d.r2, d.r0 = d.r0, offset
+		default:
+			extra := uint(lzxExtraBits[slot])
+			offset = lzxPositionBase[slot] - 2
+			if d.blockType == lzxBlockAligned && extra >= 3 {
+				offset += d.getBits(extra-3) << 3
+				offset += d.decode(&d.aligned)
+			} else {
+				offset += d.getBits(extra)
+			}
+			d.r2, d.r1, d.r0 = d.r1, d.r0, offset
+		}
+		if d.err != nil {
+			break
+		}
+
+		if d.pos+length > len(d.window) {
+			d.fail("match runs past the end of the window")
+			break
+		}
+		src := d.pos - offset
+		if src < 0 {
+			if !d.wrapped || offset > len(d.window) {
+				d.fail("match before the start of the data")
+				break
+			}
+			src += len(d.window)
+		}
+		for i := 0; i < length; i++ {
+			d.window[d.pos] = d.window[src]
+			d.pos++
+			if src++; src == len(d.window) {
+				src = 0
+			}
+		}
+	}
+	return d.pos - start
+}
+
+// lzxTranslateE8 undoes the conversion of the relative addresses of x86 call
+// instructions to absolute ones, which makes them compress better. pos is
+// where b starts in the uncompressed data.
+func lzxTranslateE8(b []byte, pos, size int32) {
+	for i := 0; i < len(b)-10; i++ {
+		if b[i] != 0xe8 {
+			pos++
+			continue
+		}
+		abs := int32(binary.LittleEndian.Uint32(b[i+1:]))
+		if abs >= -pos && abs < size {
+			rel := abs + size
+			if abs >= 0 {
+				rel = abs - pos
+			}
+			binary.LittleEndian.PutUint32(b[i+1:], uint32(rel))
+		}
+		i += 4
+		pos += 5
+	}
+}
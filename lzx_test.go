@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// A minimal LZX compressor for 32k, 64k and 2M windows, written from the
+// format description to test the decoder against. It uses fixed code
+// lengths, greedy matching and a given sequence of blocks.
+
+// lzxTestBlock is a block for lzxCompress to write. lengthTree picks one of
+// lzxTestLengthTrees.
+type lzxTestBlock struct {
+	typ        int
+	size       int
+	lengthTree int
+}
+
+var (
+	lzxTestPretree = codeLens(lzxPretreeSize, 12, 4, 5)
+	// literals and matches alike for 30, 32 and 50 position slots,
+	// complete codes
+	lzxTestMainTrees = map[uint][]byte{
+		15: codeLens(lzxNumChars+30*8, 16, 8, 9),
+		16: codeLens(lzxNumChars+32*8, 0, 9, 9),
+		21: codeLens(lzxNumChars+50*8, 368, 9, 10),
+	}
+	lzxTestLengthTrees = [][]byte{
+		codeLens(lzxLengthSize, 7, 7, 8),
+		// only two long lengths, written as runs of zeros
+		append([]byte{1, 1}, make([]byte, lzxLengthSize-2)...),
+		// no long matches at all
+		make([]byte, lzxLengthSize),
+	}
+	lzxTestAlignedTree = codeLens(lzxAlignedSize, lzxAlignedSize, 3, 3)
+)
+
+// codeLens returns n code lengths, the first short ones short and the rest
+// long
+func codeLens(n, short int, shortLen, longLen byte) []byte {
+	lens := make([]byte, n)
+	for i := range lens {
+		lens[i] = longLen
+		if i < short {
+			lens[i] = shortLen
+		}
+	}
+	return lens
+}
+
+func canonicalCodes(lens []byte) []int {
+	codes := make([]int, len(lens))
+	code := 0
+	for l := byte(1); l <= lzxMaxCodeLen; l++ {
+		for sym, sl := range lens {
+			if sl == l {
+				codes[sym] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+type lzxWriter struct {
+	out   []byte
+	acc   uint16
+	nbits uint
+}
+
+func (w *lzxWriter) bits(v int, n uint) {
+	for i := n; i > 0; i-- {
+		w.acc = w.acc<<1 | uint16(v>>(i-1)&1)
+		if w.nbits++; w.nbits == 16 {
+			w.out = append(w.out, byte(w.acc), byte(w.acc>>8))
+			w.acc, w.nbits = 0, 0
+		}
+	}
+}
+
+func (w *lzxWriter) sym(lens []byte, codes []int, sym int) {
+	if lens[sym] == 0 {
+		panic("symbol without a code")
+	}
+	w.bits(codes[sym], uint(lens[sym]))
+}
+
+func (w *lzxWriter) flush() {
+	if w.nbits != 0 {
+		w.bits(0, 16-w.nbits)
+	}
+}
+
+// lengths writes lens[first:last] delta coded against prev, using all the
+// kinds of runs where it can
+func (w *lzxWriter) lengths(prev, lens []byte, first, last int) {
+	pre := canonicalCodes(lzxTestPretree)
+	for _, l := range lzxTestPretree {
+		w.bits(int(l), 4)
+	}
+	for x := first; x < last; {
+		same := 1
+		for x+same < last && lens[x+same] == lens[x] {
+			same++
+		}
+		z := (int(prev[x]) - int(lens[x]) + 17) % 17
+		switch {
+		case lens[x] == 0 && same >= 20:
+			if same > 51 {
+				same = 51
+			}
+			w.sym(lzxTestPretree, pre, 18)
+			w.bits(same-20, 5)
+		case lens[x] == 0 && same >= 4:
+			if same > 19 {
+				same = 19
+			}
+			w.sym(lzxTestPretree, pre, 17)
+			w.bits(same-4, 4)
+		case same >= 4:
+			if same > 5 {
+				same = 5
+			}
+			w.sym(lzxTestPretree, pre, 19)
+			w.bits(same-4, 1)
+			w.sym(lzxTestPretree, pre, z)
+		default:
+			same = 1
+			w.sym(lzxTestPretree, pre, z)
+		}
+		for end := x + same; x < end; x++ {
+			prev[x] = lens[x]
+		}
+	}
+}
+
+// lzxEncodeE8 turns the relative addresses of x86 calls in a frame into
+// absolute ones, the reverse of lzxTranslateE8
+func lzxEncodeE8(b []byte, pos, size int32) {
+	for i := 0; i < len(b)-10; i++ {
+		if b[i] != 0xe8 {
+			pos++
+			continue
+		}
+		rel := int32(binary.LittleEndian.Uint32(b[i+1:]))
+		if rel >= -pos && rel < size {
+			abs := rel - size
+			if rel < size-pos {
+				abs = rel + pos
+			}
+			binary.LittleEndian.PutUint32(b[i+1:], uint32(abs))
+		}
+		i += 4
+		pos += 5
+	}
+}
+
+// lzxCompress compresses data into the given blocks, with x86 call
+// translation if e8Size isn't 0, and returns the compressed frames
+func lzxCompress(data []byte, windowBits uint, blocks []lzxTestBlock, e8Size int32) [][]byte {
+	mainTree := lzxTestMainTrees[windowBits]
+	windowSize := 1 << windowBits
+	slots := (len(mainTree) - lzxNumChars) / 8
+
+	data = append([]byte(nil), data...)
+	if e8Size != 0 {
+		for off := 0; off < len(data); off += lzxFrameSize {
+			end := off + lzxFrameSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if end-off > 10 {
+				lzxEncodeE8(data[off:end], int32(off), e8Size)
+			}
+		}
+	}
+
+	w := &lzxWriter{}
+	if e8Size != 0 {
+		w.bits(1, 1)
+		w.bits(int(e8Size>>16), 16)
+		w.bits(int(e8Size&0xffff), 16)
+	} else {
+		w.bits(0, 1)
+	}
+
+	var frames [][]byte
+	frameStart, frameEnd := 0, lzxFrameSize
+	endFrame := func(pos int) {
+		if pos >= frameEnd || pos == len(data) {
+			w.flush()
+			frames = append(frames, w.out[frameStart:])
+			frameStart = len(w.out)
+			frameEnd += lzxFrameSize
+		}
+	}
+
+	mainCodes := canonicalCodes(mainTree)
+	alignedCodes := canonicalCodes(lzxTestAlignedTree)
+	mainLens := make([]byte, len(mainTree))
+	lengthLens := make([]byte, lzxLengthSize)
+	r := [3]int{1, 1, 1}
+	last := map[string]int{}
+
+	pos := 0
+	for _, b := range blocks {
+		end := pos + b.size
+		w.bits(b.typ, 3)
+		w.bits(b.size>>8, 16)
+		w.bits(b.size&0xff, 8)
+
+		if b.typ == lzxBlockUncompressed {
+			if w.nbits == 0 {
+				w.bits(0, 16)
+			}
+			w.flush()
+			for _, v := range r {
+				w.out = append(w.out, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+			}
+			for ; pos < end; pos++ {
+				w.out = append(w.out, data[pos])
+				if pos+3 <= len(data) {
+					last[string(data[pos:pos+3])] = pos
+				}
+				endFrame(pos + 1)
+			}
+			if b.size&1 != 0 {
+				w.out = append(w.out, 0)
+			}
+			continue
+		}
+
+		if b.typ == lzxBlockAligned {
+			for _, l := range lzxTestAlignedTree {
+				w.bits(int(l), 3)
+			}
+		}
+		w.lengths(mainLens, mainTree, 0, lzxNumChars)
+		w.lengths(mainLens, mainTree, lzxNumChars, len(mainTree))
+		lengthTree := lzxTestLengthTrees[b.lengthTree]
+		w.lengths(lengthLens, lengthTree, 0, lzxLengthSize)
+		lengthCodes := canonicalCodes(lengthTree)
+
+		for pos < end {
+			length, offset := 0, 0
+			if pos+3 <= end {
+				// matches may run into the next frame, but not past the
+				// end of the window
+				limit := end
+				if wend := (pos/windowSize + 1) * windowSize; wend < limit {
+					limit = wend
+				}
+				if prev, ok := last[string(data[pos:pos+3])]; ok && pos-prev <= windowSize-3 {
+					offset = pos - prev
+					for length < 257 && pos+length < limit && data[prev+length] == data[pos+length] {
+						length++
+					}
+				}
+			}
+			// the longest match the length tree can code
+			for length > 8 && lengthTree[length-9] == 0 {
+				length--
+			}
+			if length < 3 {
+				w.sym(mainTree, mainCodes, int(data[pos]))
+				length = 1
+			} else {
+				header := length - 2
+				if header > 7 {
+					header = 7
+				}
+				var slot, extra int
+				switch offset {
+				case r[0]:
+				case r[1]:
+					slot = 1
+					r[0], r[1] = r[1], r[0]
+				case r[2]:
+					slot = 2
+					r[0], r[2] = r[2], r[0]
+				default:
+					v := offset + 2
+					for slot = 3; slot+1 < slots && lzxPositionBase[slot+1] <= v; slot++ {
+					}
+					extra = v - lzxPositionBase[slot]
+					r[0], r[1], r[2] = offset, r[0], r[1]
+				}
+				w.sym(mainTree, mainCodes, lzxNumChars+slot*8+header)
+				if header == 7 {
+					w.sym(lengthTree, lengthCodes, length-9)
+				}
+				if slot >= 3 {
+					n := uint(lzxExtraBits[slot])
+					if b.typ == lzxBlockAligned && n >= 3 {
+						w.bits(extra>>3, n-3)
+						w.sym(lzxTestAlignedTree, alignedCodes, extra&7)
+					} else {
+						w.bits(extra, n)
+					}
+				}
+			}
+			for i := 0; i < length; i++ {
+				if pos+3 <= len(data) {
+					last[string(data[pos:pos+3])] = pos
+				}
+				pos++
+			}
+			endFrame(pos)
+		}
+	}
+	if pos != len(data) {
+		panic("blocks don't cover the data")
+	}
+	return frames
+}
+
+// cabFolderData writes frames as the data blocks of a cabinet folder, the
+// last with the rest of size
+func cabFolderData(frames [][]byte, size int) []byte {
+	var buf bytes.Buffer
+	for i, f := range frames {
+		n := lzxFrameSize
+		if i == len(frames)-1 {
+			n = size - i*lzxFrameSize
+		}
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Checksum                 uint32
+			Compressed, Uncompressed uint16
+		}{0, uint16(len(f)), uint16(n)})
+		buf.Write(f)
+	}
+	return buf.Bytes()
+}
+
+func lzxDecompress(frames [][]byte, windowBits uint, size int) ([]byte, error) {
+	folder := cabFolder{NumData: uint16(len(frames)), Compression: cabCompressLZX | uint16(windowBits)<<8}
+	fr, err := newCabFolderReader(bytes.NewReader(cabFolderData(frames, size)), folder, 0)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(fr)
+}
+
+// lzxTestData returns text, random bytes and x86 calls to compress
+func lzxTestData(n int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		switch rnd.Intn(4) {
+		case 0:
+			buf.WriteString("package runtime // the Go runtime\n")
+		case 1:
+			b := make([]byte, rnd.Intn(300))
+			rnd.Read(b)
+			buf.Write(b)
+		case 2:
+			var call [5]byte
+			call[0] = 0xe8
+			binary.LittleEndian.PutUint32(call[1:], uint32(rnd.Intn(1<<17)-1<<16))
+			buf.Write(call[:])
+		case 3:
+			buf.Write(bytes.Repeat([]byte{'x'}, rnd.Intn(600)))
+		}
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestLZXDecode(t *testing.T) {
+	data := lzxTestData(150000)
+	tests := []struct {
+		name       string
+		windowBits uint
+		blocks     []lzxTestBlock
+		e8Size     int32
+	}{
+		{"verbatim", 16, []lzxTestBlock{{lzxBlockVerbatim, 150000, 0}}, 0},
+		{"aligned", 16, []lzxTestBlock{{lzxBlockAligned, 150000, 0}}, 0},
+		{"uncompressed", 16, []lzxTestBlock{{lzxBlockUncompressed, 150000, 0}}, 0},
+		{"mixed", 16, []lzxTestBlock{
+			{lzxBlockVerbatim, 20001, 0},
+			{lzxBlockUncompressed, 4001, 0},
+			{lzxBlockAligned, 40000, 1},
+			{lzxBlockUncompressed, 12, 0},
+			{lzxBlockVerbatim, 50000, 2},
+			{lzxBlockAligned, 35986, 0},
+		}, 0},
+		// the window wraps around after every frame
+		{"small window", 15, []lzxTestBlock{
+			{lzxBlockAligned, 70000, 0},
+			{lzxBlockVerbatim, 80000, 0},
+		}, 0},
+		{"x86 calls", 16, []lzxTestBlock{
+			{lzxBlockAligned, 100000, 0},
+			{lzxBlockUncompressed, 50000, 0},
+		}, 200000},
+	}
+	for _, tt := range tests {
+		frames := lzxCompress(data, tt.windowBits, tt.blocks, tt.e8Size)
+		got, err := lzxDecompress(frames, tt.windowBits, len(data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s: decompressed data differs", tt.name)
+		}
+	}
+}
+
+func TestLZXDecodeCorrupt(t *testing.T) {
+	data := lzxTestData(70000)
+	frames := lzxCompress(data, 16, []lzxTestBlock{{lzxBlockVerbatim, 70000, 0}}, 0)
+
+	truncated := append([][]byte(nil), frames...)
+	last := truncated[len(truncated)-1]
+	truncated[len(truncated)-1] = last[:len(last)/2]
+	if _, err := lzxDecompress(truncated, 16, len(data)); err == nil {
+		t.Error("truncated data decompressed without error")
+	}
+
+	// a block type that doesn't exist
+	bad := append([][]byte(nil), frames...)
+	bad[0] = append([]byte(nil), frames[0]...)
+	bad[0][1] |= 0x70
+	if _, err := lzxDecompress(bad, 16, len(data)); err == nil {
+		t.Error("bad block type decompressed without error")
+	}
+
+	folder := cabFolder{NumData: 1, Compression: cabCompressLZX | 22<<8}
+	if _, err := newCabFolderReader(bytes.NewReader(nil), folder, 0); err == nil {
+		t.Error("window size of 2^22 accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// manifestName is the file in a built GOROOT that records how gonative
+// built it, so later builds can add platforms to it instead of starting over
+const manifestName = ".gonative.json"
+
+type buildManifest struct {
+	Version   string    `json:"version"`
+	Host      string    `json:"host"`
+	Platforms []string  `json:"platforms"`
+	Built     time.Time `json:"built"`
+
+	// the C toolchains of the platforms that have one
+	Toolchains map[string]*crossToolchain `json:"toolchains,omitempty"`
+}
+
+func hostPlatform() Platform {
+	return Platform{runtime.GOOS, runtime.GOARCH}
+}
+
+// readManifest reads the manifest of the gonative build at goRoot
+func readManifest(goRoot string) (*buildManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(goRoot, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m buildManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Bad build manifest in %s: %v", goRoot, err)
+	}
+	return &m, nil
+}
+
+// writeManifest records that goRoot has Go version built for the host and
+// platforms, and the toolchains to build for them with cgo
+func writeManifest(goRoot string, version GoVersion, platforms []Platform, toolchains map[Platform]*crossToolchain) error {
+	host := hostPlatform()
+	m := buildManifest{Version: version.String(), Host: host.String(), Built: time.Now().UTC()}
+	for _, p := range platforms {
+		m.Platforms = append(m.Platforms, p.String())
+		if tc := toolchains[p]; tc != nil {
+			if m.Toolchains == nil {
+				m.Toolchains = make(map[string]*crossToolchain)
+			}
+			m.Toolchains[p.String()] = tc
+		}
+	}
+	data, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(goRoot, manifestName), append(data, '\n'), 0644)
+}
+
+// compatible checks that the build is of version and runs on this host, so
+// that platforms can be added to it
+func (m *buildManifest) compatible(version GoVersion) error {
+	built, err := ParseGoVersion(m.Version)
+	if err != nil {
+		return err
+	}
+	if built.Compare(version) != 0 {
+		return fmt.Errorf("Existing build is Go %s, not %s", built, version)
+	}
+	if host := hostPlatform(); m.Host != host.String() {
+		return fmt.Errorf("Existing build is for a %s host, not %s", m.Host, host.String())
+	}
+	return nil
+}
+
+func (m *buildManifest) platforms() (platforms []Platform) {
+	for _, s := range m.Platforms {
+		if p, err := parsePlatform(s); err == nil {
+			platforms = append(platforms, p)
+		}
+	}
+	return
+}
+
+// toolchain returns the C toolchain recorded for p, nil if there is none
+func (m *buildManifest) toolchain(p Platform) *crossToolchain {
+	return m.Toolchains[p.String()]
+}
+
+func (m *buildManifest) has(p Platform) bool {
+	for _, s := range m.Platforms {
+		if s == p.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// incrementalBuild decides whether the build can add platforms to the
+// existing build at targetPath instead of building Go from scratch. It does
+// when platforms are added explicitly with AddPlatforms, or when the target
+// is a build of the same version for this host and Force isn't set. It
+// returns the existing build's manifest in that case, with opts.Platforms
+// narrowed down to the platforms the existing build lacks, and nil
+// otherwise.
+func incrementalBuild(opts *Options, targetPath string) (*buildManifest, error) {
+	m, err := readManifest(targetPath)
+	if len(opts.AddPlatforms) > 0 {
+		if err != nil {
+			return nil, fmt.Errorf("No gonative build in %s to add platforms to: %v", targetPath, err)
+		}
+		if opts.Version == (GoVersion{}) {
+			if opts.Version, err = ParseGoVersion(m.Version); err != nil {
+				return nil, err
+			}
+		}
+		if err := m.compatible(opts.Version); err != nil {
+			return nil, err
+		}
+		opts.Platforms = append(m.platforms(), opts.AddPlatforms...)
+	} else if err != nil || opts.Force || m.compatible(opts.Version) != nil {
+		return nil, nil
+	}
+
+	var missing []Platform
+	seen := make(map[Platform]bool)
+	for _, p := range opts.Platforms {
+		if !m.has(p) && !seen[p] {
+			missing = append(missing, p)
+		}
+		seen[p] = true
+	}
+	opts.Platforms = missing
+	return m, nil
+}
+
+// parsePlatform parses a platform like linux_amd64
+func parsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "_")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("Invalid platform string: %v", s)
+	}
+	return Platform{parts[0], parts[1]}, nil
+}
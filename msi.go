@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Support for windows .msi installers. An MSI is a compound file (the OLE2
+// structured storage format) holding database tables as streams, plus the
+// installed files in an embedded cabinet. The cabinet only has the files'
+// keys from the File table; their directories come from the Component and
+// Directory tables.
+
+var magicCFB = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// unpackMsi extracts the parts of the Go tree that pass filter from a windows
+// installer
+func unpackMsi(ctx context.Context, dest string, r *os.File, filter *extractFilter) error {
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	cf, err := openCompoundFile(r, fi.Size())
+	if err != nil {
+		return err
+	}
+	db, err := openMsiDatabase(cf)
+	if err != nil {
+		return err
+	}
+	paths, err := db.filePaths()
+	if err != nil {
+		return err
+	}
+
+	x, err := newExtractor(ctx, dest, filter)
+	if err != nil {
+		return err
+	}
+	cabs := 0
+	for _, name := range cf.streamNames() {
+		rd, err := cf.stream(name)
+		if err != nil {
+			return err
+		}
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(rd, magic); err != nil || !bytes.Equal(magic, magicCab) {
+			continue
+		}
+		rd, _ = cf.stream(name)
+		if err := unpackCab(x, rd, paths); err != nil {
+			return fmt.Errorf("cabinet %s: %v", msiStreamName(name), err)
+		}
+		cabs++
+	}
+	if cabs == 0 {
+		return fmt.Errorf("installer has no embedded cabinet")
+	}
+	return x.Close()
+}
+
+//
+// compound file
+//
+
+const (
+	cfbEndOfChain = 0xfffffffe
+	cfbFreeSect   = 0xffffffff
+	cfbNoStream   = 0xffffffff
+)
+
+type cfbHeader struct {
+	Signature         [8]byte
+	CLSID             [16]byte
+	MinorVersion      uint16
+	MajorVersion      uint16
+	ByteOrder         uint16
+	SectorShift       uint16
+	MiniSectorShift   uint16
+	Reserved          [6]byte
+	NumDirSectors     uint32
+	NumFATSectors     uint32
+	FirstDirSector    uint32
+	TransactionSig    uint32
+	MiniStreamCutoff  uint32
+	FirstMiniFATSect  uint32
+	NumMiniFATSectors uint32
+	FirstDIFATSector  uint32
+	NumDIFATSectors   uint32
+	DIFAT             [109]uint32
+}
+
+type cfbDirEntry struct {
+	Name        [32]uint16
+	NameLen     uint16
+	Type        uint8
+	Color       uint8
+	Left        uint32
+	Right       uint32
+	Child       uint32
+	CLSID       [16]byte
+	State       uint32
+	Created     uint64
+	Modified    uint64
+	StartSector uint32
+	Size        uint64
+}
+
+const (
+	cfbTypeStream = 2
+	cfbTypeRoot   = 5
+)
+
+// compoundFile reads the streams of an OLE2 compound file. All streams in an
+// MSI are in the root storage, so the directory is treated as a flat list.
+type compoundFile struct {
+	r          io.ReaderAt
+	sectorSize int64
+	miniSize   int64
+	miniCutoff uint64
+	fat        []uint32
+	miniFAT    []uint32
+	miniStream []byte
+	streams    map[string]cfbDirEntry
+}
+
+// openCompoundFile reads the header, FAT and directory of the compound file
+// of size bytes in r
+func openCompoundFile(r io.ReaderAt, size int64) (*compoundFile, error) {
+	var hdr cfbHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, 512), binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr.Signature[:], magicCFB) {
+		return nil, fmt.Errorf("not a compound file")
+	}
+	if hdr.SectorShift != 9 && hdr.SectorShift != 12 {
+		return nil, fmt.Errorf("bad compound file sector size: 2^%d", hdr.SectorShift)
+	}
+	cf := &compoundFile{
+		r:          r,
+		sectorSize: 1 << hdr.SectorShift,
+		miniSize:   1 << hdr.MiniSectorShift,
+		miniCutoff: uint64(hdr.MiniStreamCutoff),
+		streams:    make(map[string]cfbDirEntry),
+	}
+
+	// the sectors of the FAT are listed in the header and DIFAT sectors,
+	// and there can't be more of them than the file has
+	if int64(hdr.NumFATSectors) > size/cf.sectorSize {
+		return nil, fmt.Errorf("bad compound file: %d FAT sectors in %d bytes", hdr.NumFATSectors, size)
+	}
+	fatSectors := make([]uint32, 0, hdr.NumFATSectors)
+	for _, s := range hdr.DIFAT {
+		if s != cfbFreeSect {
+			fatSectors = append(fatSectors, s)
+		}
+	}
+	perSector := int(cf.sectorSize / 4)
+	for s, n := hdr.FirstDIFATSector, uint32(0); s != cfbEndOfChain && s != cfbFreeSect && n < hdr.NumDIFATSectors; n++ {
+		entries, err := cf.readUint32s(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries[:perSector-1] {
+			if e != cfbFreeSect {
+				fatSectors = append(fatSectors, e)
+			}
+		}
+		s = entries[perSector-1]
+	}
+	for _, s := range fatSectors {
+		entries, err := cf.readUint32s(s)
+		if err != nil {
+			return nil, err
+		}
+		cf.fat = append(cf.fat, entries...)
+	}
+
+	// directory
+	dir, err := cf.readChain(hdr.FirstDirSector, -1)
+	if err != nil {
+		return nil, fmt.Errorf("bad compound file directory: %v", err)
+	}
+	var root *cfbDirEntry
+	for off := 0; off+128 <= len(dir); off += 128 {
+		var e cfbDirEntry
+		if err := binary.Read(bytes.NewReader(dir[off:off+128]), binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+		switch e.Type {
+		case cfbTypeRoot:
+			if root == nil {
+				root = &e
+			}
+		case cfbTypeStream:
+			cf.streams[e.name()] = e
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("compound file has no root entry")
+	}
+
+	// small streams live in the mini stream, which is stored like a regular
+	// stream starting at the root entry's sector
+	if hdr.FirstMiniFATSect != cfbEndOfChain {
+		miniFAT, err := cf.readChain(hdr.FirstMiniFATSect, -1)
+		if err != nil {
+			return nil, fmt.Errorf("bad compound file mini FAT: %v", err)
+		}
+		cf.miniFAT = make([]uint32, len(miniFAT)/4)
+		binary.Read(bytes.NewReader(miniFAT), binary.LittleEndian, cf.miniFAT)
+		if cf.miniStream, err = cf.readChain(root.StartSector, int64(root.Size)); err != nil {
+			return nil, fmt.Errorf("bad compound file mini stream: %v", err)
+		}
+	}
+	return cf, nil
+}
+
+func (e *cfbDirEntry) name() string {
+	n := int(e.NameLen/2) - 1
+	if n < 0 || n > len(e.Name) {
+		n = 0
+	}
+	return string(utf16.Decode(e.Name[:n]))
+}
+
+func (cf *compoundFile) readUint32s(sector uint32) ([]uint32, error) {
+	vals := make([]uint32, cf.sectorSize/4)
+	sr := io.NewSectionReader(cf.r, (int64(sector)+1)*cf.sectorSize, cf.sectorSize)
+	return vals, binary.Read(sr, binary.LittleEndian, vals)
+}
+
+// readChain reads the regular sectors chained in the FAT starting at start.
+// If size is negative, the whole chain is read.
+func (cf *compoundFile) readChain(start uint32, size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	for s, n := start, 0; s != cfbEndOfChain; n++ {
+		if int(s) >= len(cf.fat) || n > len(cf.fat) {
+			return nil, fmt.Errorf("bad sector chain")
+		}
+		sr := io.NewSectionReader(cf.r, (int64(s)+1)*cf.sectorSize, cf.sectorSize)
+		if _, err := io.Copy(&buf, sr); err != nil {
+			return nil, err
+		}
+		if size >= 0 && int64(buf.Len()) >= size {
+			break
+		}
+		s = cf.fat[s]
+	}
+	if size >= 0 {
+		if int64(buf.Len()) < size {
+			return nil, fmt.Errorf("stream shorter than its size")
+		}
+		return buf.Bytes()[:size], nil
+	}
+	return buf.Bytes(), nil
+}
+
+func (cf *compoundFile) streamNames() (names []string) {
+	for name := range cf.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// stream returns a reader for the named stream. Large streams are read
+// from the file as needed since the cabinet may be hundreds of megabytes.
+func (cf *compoundFile) stream(name string) (io.Reader, error) {
+	e, ok := cf.streams[name]
+	if !ok {
+		return nil, fmt.Errorf("compound file has no stream %q", msiStreamName(name))
+	}
+	if e.Size >= cf.miniCutoff {
+		return &cfbChainReader{cf: cf, sector: e.StartSector, remaining: int64(e.Size)}, nil
+	}
+
+	var buf bytes.Buffer
+	for s, n := e.StartSector, 0; s != cfbEndOfChain && int64(buf.Len()) < int64(e.Size); n++ {
+		off := int64(s) * cf.miniSize
+		if int(s) >= len(cf.miniFAT) || n > len(cf.miniFAT) || off+cf.miniSize > int64(len(cf.miniStream)) {
+			return nil, fmt.Errorf("bad mini sector chain in stream %q", msiStreamName(name))
+		}
+		buf.Write(cf.miniStream[off : off+cf.miniSize])
+		s = cf.miniFAT[s]
+	}
+	if int64(buf.Len()) < int64(e.Size) {
+		return nil, fmt.Errorf("stream %q shorter than its size", msiStreamName(name))
+	}
+	return bytes.NewReader(buf.Bytes()[:e.Size]), nil
+}
+
+// cfbChainReader reads a stream stored in regular sectors
+type cfbChainReader struct {
+	cf        *compoundFile
+	sector    uint32
+	offset    int64
+	remaining int64
+}
+
+func (c *cfbChainReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if c.offset == c.cf.sectorSize {
+		if int(c.sector) >= len(c.cf.fat) {
+			return 0, fmt.Errorf("bad sector chain")
+		}
+		c.sector, c.offset = c.cf.fat[c.sector], 0
+	}
+	if c.sector == cfbEndOfChain || int(c.sector) >= len(c.cf.fat) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := c.cf.sectorSize - c.offset
+	if n > c.remaining {
+		n = c.remaining
+	}
+	if int64(len(p)) > n {
+		p = p[:n]
+	}
+	read, err := c.cf.r.ReadAt(p, (int64(c.sector)+1)*c.cf.sectorSize+c.offset)
+	c.offset += int64(read)
+	c.remaining -= int64(read)
+	if err == io.EOF && read == len(p) {
+		err = nil
+	}
+	return read, err
+}
+
+//
+// MSI database
+//
+
+// msiStreamName decodes the compressed stream names MSI uses, where most
+// characters pack two name characters into one and table streams start with
+// a marker that is shown as '!' here
+func msiStreamName(name string) string {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz._"
+	var out []rune
+	for _, c := range name {
+		switch {
+		case c >= 0x3800 && c < 0x4800:
+			c -= 0x3800
+			out = append(out, rune(chars[c&0x3f]), rune(chars[(c>>6)&0x3f]))
+		case c >= 0x4800 && c < 0x4840:
+			out = append(out, rune(chars[c-0x4800]))
+		case c == 0x4840:
+			out = append(out, '!')
+		default:
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
+
+// column type bits from msidefs.h
+const (
+	msiTypeString   = 0x0800
+	msiTypeNullable = 0x1000
+	msiTypeValid    = 0x0100
+)
+
+type msiDatabase struct {
+	cf      *compoundFile
+	streams map[string]string // decoded name -> raw stream name
+	strings []string
+	strRef  int              // bytes per string reference
+	columns map[string][]int // table -> column types in order
+}
+
+func openMsiDatabase(cf *compoundFile) (*msiDatabase, error) {
+	db := &msiDatabase{cf: cf, streams: make(map[string]string), strRef: 2}
+	for raw := range cf.streams {
+		db.streams[msiStreamName(raw)] = raw
+	}
+	if err := db.loadStrings(); err != nil {
+		return nil, err
+	}
+
+	// the column definitions of every table are in the _Columns table, whose
+	// own layout is fixed: Table, Number, Name, Type
+	cols, err := db.table("_Columns", []int{msiTypeString, 2, msiTypeString, 2})
+	if err != nil {
+		return nil, err
+	}
+	type column struct{ number, typ int }
+	byTable := make(map[string][]column)
+	for _, row := range cols {
+		t := db.str(row[0])
+		byTable[t] = append(byTable[t], column{row[1], row[3]})
+	}
+	db.columns = make(map[string][]int)
+	for t, cs := range byTable {
+		sort.Slice(cs, func(i, j int) bool { return cs[i].number < cs[j].number })
+		for _, c := range cs {
+			db.columns[t] = append(db.columns[t], c.typ)
+		}
+	}
+	return db, nil
+}
+
+func (db *msiDatabase) readStream(name string) ([]byte, error) {
+	raw, ok := db.streams[name]
+	if !ok {
+		return nil, fmt.Errorf("installer has no %s stream", name)
+	}
+	rd, err := db.cf.stream(raw)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(rd)
+}
+
+// loadStrings reads the string pool every string column refers to
+func (db *msiDatabase) loadStrings() error {
+	pool, err := db.readStream("!_StringPool")
+	if err != nil {
+		return err
+	}
+	data, err := db.readStream("!_StringData")
+	if err != nil {
+		return err
+	}
+	if len(pool) < 4 {
+		return fmt.Errorf("bad MSI string pool")
+	}
+	if binary.LittleEndian.Uint16(pool[2:])&0x8000 != 0 {
+		db.strRef = 3
+	}
+
+	// string ids start at 1, entries are (length, refcount) pairs
+	db.strings = []string{""}
+	word := func(i int) int { return int(binary.LittleEndian.Uint16(pool[i*2:])) }
+	count := len(pool) / 4
+	for i := 1; i < count; {
+		length, refs := word(i*2), word(i*2+1)
+		switch {
+		case length == 0 && refs == 0:
+			i++
+		case length == 0:
+			// strings over 64k are spread over two entries
+			if i+1 >= count {
+				return fmt.Errorf("bad MSI string pool")
+			}
+			length = word(i*2+3)<<16 | word(i*2+2)
+			i += 2
+		default:
+			i++
+		}
+		if length > len(data) {
+			return fmt.Errorf("bad MSI string pool")
+		}
+		db.strings = append(db.strings, string(data[:length]))
+		data = data[length:]
+	}
+	return nil
+}
+
+func (db *msiDatabase) str(id int) string {
+	if id <= 0 || id >= len(db.strings) {
+		return ""
+	}
+	return db.strings[id]
+}
+
+// table reads all rows of a table. Values of string columns are string ids,
+// null integers are returned as 0.
+func (db *msiDatabase) table(name string, types []int) ([][]int, error) {
+	data, err := db.readStream("!" + name)
+	if err != nil {
+		return nil, err
+	}
+	widths := make([]int, len(types))
+	rowSize := 0
+	for i, t := range types {
+		switch {
+		case t&msiTypeString != 0 && t&^msiTypeNullable == msiTypeString|msiTypeValid:
+			// binary data stored in streams of their own
+			widths[i] = 2
+		case t&msiTypeString != 0:
+			widths[i] = db.strRef
+		case t&0xff <= 2:
+			widths[i] = 2
+		default:
+			widths[i] = 4
+		}
+		rowSize += widths[i]
+	}
+	if rowSize == 0 || len(data)%rowSize != 0 {
+		return nil, fmt.Errorf("bad MSI table %s", name)
+	}
+
+	// values are stored column by column
+	n := len(data) / rowSize
+	rows := make([][]int, n)
+	for r := range rows {
+		rows[r] = make([]int, len(types))
+	}
+	off := 0
+	for c, w := range widths {
+		for r := 0; r < n; r++ {
+			v := 0
+			for b := w - 1; b >= 0; b-- {
+				v = v<<8 | int(data[off+b])
+			}
+			off += w
+			if types[c]&msiTypeString == 0 && v != 0 {
+				// integers are stored offset so that 0 can mean null
+				if w == 2 {
+					v -= 0x8000
+				} else {
+					v -= 0x80000000
+				}
+			}
+			rows[r][c] = v
+		}
+	}
+	return rows, nil
+}
+
+// tableByName reads a table with the column layout from _Columns
+func (db *msiDatabase) tableByName(name string) ([][]int, error) {
+	types, ok := db.columns[name]
+	if !ok {
+		return nil, fmt.Errorf("installer has no %s table", name)
+	}
+	return db.table(name, types)
+}
+
+// filePaths maps the keys of the File table, which are what files are called
+// in the cabinet, to their paths in the Go tree
+func (db *msiDatabase) filePaths() (map[string]string, error) {
+	dirs, err := db.tableByName("Directory")
+	if err != nil {
+		return nil, err
+	}
+	comps, err := db.tableByName("Component")
+	if err != nil {
+		return nil, err
+	}
+	files, err := db.tableByName("File")
+	if err != nil {
+		return nil, err
+	}
+
+	// Directory: Directory, Directory_Parent, DefaultDir
+	type dirEntry struct{ parent, name string }
+	dirTable := make(map[string]dirEntry)
+	for _, row := range dirs {
+		dirTable[db.str(row[0])] = dirEntry{db.str(row[1]), msiLongName(db.str(row[2]))}
+	}
+	var dirPath func(key string, depth int) string
+	dirPath = func(key string, depth int) string {
+		d, ok := dirTable[key]
+		if !ok || depth > len(dirTable) {
+			return ""
+		}
+		parent := ""
+		if d.parent != "" && d.parent != key {
+			parent = dirPath(d.parent, depth+1)
+		}
+		if d.name == "." || d.name == "SourceDir" {
+			return parent
+		}
+		return path.Join(parent, d.name)
+	}
+
+	// Component: Component, ComponentId, Directory_, ...
+	compDirs := make(map[string]string)
+	for _, row := range comps {
+		compDirs[db.str(row[0])] = db.str(row[2])
+	}
+
+	// File: File, Component_, FileName, ...
+	paths := make(map[string]string)
+	for _, row := range files {
+		dir := dirPath(compDirs[db.str(row[1])], 0)
+		p := path.Join(dir, msiLongName(db.str(row[2])))
+		if goPath, ok := installedGoPath(p); ok {
+			paths[db.str(row[0])] = goPath
+		}
+	}
+	return paths, nil
+}
+
+// msiLongName picks the long target name out of names like
+// "target:source" and "SHORT~1|long name"
+func msiLongName(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, "|"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+//
+// cabinet
+//
+
+var magicCab = []byte("MSCF")
+
+const (
+	cabFlagPrev     = 0x0001
+	cabFlagNext     = 0x0002
+	cabFlagReserve  = 0x0004
+	cabCompressMask = 0x000f
+	cabCompressNone = 0
+	cabCompressZip  = 1
+	cabCompressLZX  = 3
+)
+
+type cabHeader struct {
+	Signature    [4]byte
+	Reserved1    uint32
+	CabinetSize  uint32
+	Reserved2    uint32
+	FilesOffset  uint32
+	Reserved3    uint32
+	VersionMinor uint8
+	VersionMajor uint8
+	NumFolders   uint16
+	NumFiles     uint16
+	Flags        uint16
+	SetID        uint16
+	Index        uint16
+}
+
+type cabFolder struct {
+	DataOffset  uint32
+	NumData     uint16
+	Compression uint16
+}
+
+type cabFileHeader struct {
+	Size         uint32
+	FolderOffset uint32
+	Folder       uint16
+	Date         uint16
+	Time         uint16
+	Attribs      uint16
+}
+
+type cabFile struct {
+	cabFileHeader
+	name string
+}
+
+// unpackCab extracts the files of the cabinet read from r that have a path
+// in paths. The cabinet is read front to back, with only its directory kept
+// in memory, so the folders have to come in the order of their data.
+func unpackCab(x *extractor, r io.Reader, paths map[string]string) error {
+	rd := &cabReader{r: bufio.NewReader(r)}
+
+	var hdr cabHeader
+	if err := binary.Read(rd, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.Flags&(cabFlagPrev|cabFlagNext) != 0 {
+		return fmt.Errorf("multi-part cabinets are not supported")
+	}
+	if int64(hdr.CabinetSize) > x.maxSize {
+		return fmt.Errorf("cabinet is larger than %d bytes", x.maxSize)
+	}
+	var folderReserve, dataReserve int64
+	if hdr.Flags&cabFlagReserve != 0 {
+		var res struct {
+			Header uint16
+			Folder uint8
+			Data   uint8
+		}
+		if err := binary.Read(rd, binary.LittleEndian, &res); err != nil {
+			return err
+		}
+		if err := rd.skip(int64(res.Header)); err != nil {
+			return err
+		}
+		folderReserve, dataReserve = int64(res.Folder), int64(res.Data)
+	}
+
+	folders := make([]cabFolder, hdr.NumFolders)
+	for i := range folders {
+		if err := binary.Read(rd, binary.LittleEndian, &folders[i]); err != nil {
+			return err
+		}
+		if err := rd.skip(folderReserve); err != nil {
+			return err
+		}
+	}
+
+	if err := rd.skipTo(int64(hdr.FilesOffset)); err != nil {
+		return err
+	}
+	files := make([]cabFile, hdr.NumFiles)
+	for i := range files {
+		f := &files[i]
+		if err := binary.Read(rd, binary.LittleEndian, &f.cabFileHeader); err != nil {
+			return err
+		}
+		var name []byte
+		for {
+			b, err := rd.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+			if len(name) == maxCabName {
+				return fmt.Errorf("file name in cabinet is too long")
+			}
+			name = append(name, b)
+		}
+		f.name = string(name)
+	}
+
+	order := make([]int, len(folders))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return folders[order[a]].DataOffset < folders[order[b]].DataOffset })
+	for _, i := range order {
+		folder := folders[i]
+		var inFolder []cabFile
+		for _, f := range files {
+			if int(f.Folder) == i {
+				inFolder = append(inFolder, f)
+			}
+		}
+		sort.Slice(inFolder, func(a, b int) bool { return inFolder[a].FolderOffset < inFolder[b].FolderOffset })
+
+		if err := rd.skipTo(int64(folder.DataOffset)); err != nil {
+			return err
+		}
+		fr, err := newCabFolderReader(rd, folder, dataReserve)
+		if err != nil {
+			return err
+		}
+		var pos int64
+		for _, f := range inFolder {
+			if int64(f.FolderOffset) < pos {
+				return fmt.Errorf("overlapping files in cabinet: %s", f.name)
+			}
+			if _, err := io.CopyN(ioutil.Discard, fr, int64(f.FolderOffset)-pos); err != nil {
+				return err
+			}
+			pos = int64(f.FolderOffset) + int64(f.Size)
+
+			content := io.LimitReader(fr, int64(f.Size))
+			if name, ok := paths[f.name]; ok && x.Wants(name) {
+				if err := x.File(name, content, 0644, dosTime(f.Date, f.Time)); err != nil {
+					return err
+				}
+			}
+			// the next file starts where this one ends
+			if _, err := io.Copy(ioutil.Discard, content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the longest file name unpackCab accepts, the format allows 256 bytes
+const maxCabName = 1024
+
+// cabReader keeps track of the offset in a cabinet that is read in order
+type cabReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (c *cabReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *cabReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.offset++
+	}
+	return b, err
+}
+
+func (c *cabReader) skip(n int64) error {
+	if _, err := io.CopyN(ioutil.Discard, c, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// skipTo moves ahead to offset, which can't be behind what was read already
+func (c *cabReader) skipTo(offset int64) error {
+	if offset < c.offset {
+		return fmt.Errorf("cabinet is not in order, can't go back to offset %d from %d", offset, c.offset)
+	}
+	return c.skip(offset - c.offset)
+}
+
+func dosTime(date, tm uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xf), int(date&0x1f),
+		int(tm>>11), int(tm>>5&0x3f), int(tm&0x1f)*2, 0, time.Local)
+}
+
+// cabFolderReader reads the uncompressed contents of a cabinet folder, which
+// is the concatenation of its data blocks
+type cabFolderReader struct {
+	r           io.Reader
+	remaining   int
+	reserve     int64
+	compression uint16
+
+	// the compressed data of the current block, and the uncompressed sizes
+	// of the blocks read so far but not decompressed yet
+	payload []byte
+	sizes   []int
+
+	// MSZIP blocks are compressed with the previous 32k of output as history
+	window []byte
+	// LZX data runs on from one block to the next, each block decompresses
+	// to one frame
+	lzx   *lzxDecoder
+	block []byte
+}
+
+func newCabFolderReader(r io.Reader, folder cabFolder, reserve int64) (*cabFolderReader, error) {
+	c := &cabFolderReader{
+		r:           r,
+		remaining:   int(folder.NumData),
+		reserve:     reserve,
+		compression: folder.Compression & cabCompressMask,
+	}
+	switch c.compression {
+	case cabCompressNone, cabCompressZip:
+		return c, nil
+	case cabCompressLZX:
+		lzx, err := newLZXDecoder(c, uint(folder.Compression>>8&0x1f))
+		if err != nil {
+			return nil, err
+		}
+		c.lzx = lzx
+		return c, nil
+	}
+	return nil, fmt.Errorf("cabinet compression type %d is not supported, only stored, MSZIP and LZX are", c.compression)
+}
+
+func (c *cabFolderReader) Read(p []byte) (int, error) {
+	for len(c.block) == 0 {
+		if c.remaining == 0 && len(c.sizes) == 0 {
+			return 0, io.EOF
+		}
+		if err := c.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.block)
+	c.block = c.block[n:]
+	return n, nil
+}
+
+// ReadByte returns the next byte of compressed data, going on to the next
+// block at the end of one
+func (c *cabFolderReader) ReadByte() (byte, error) {
+	for len(c.payload) == 0 {
+		if c.remaining == 0 {
+			return 0, io.EOF
+		}
+		if err := c.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	b := c.payload[0]
+	c.payload = c.payload[1:]
+	return b, nil
+}
+
+// readBlock reads the next data block into c.payload
+func (c *cabFolderReader) readBlock() error {
+	var hdr struct {
+		Checksum     uint32
+		Compressed   uint16
+		Uncompressed uint16
+	}
+	if err := binary.Read(c.r, binary.LittleEndian, &hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, c.r, c.reserve); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	c.payload = make([]byte, hdr.Compressed)
+	if _, err := io.ReadFull(c.r, c.payload); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	c.sizes = append(c.sizes, int(hdr.Uncompressed))
+	c.remaining--
+	return nil
+}
+
+func (c *cabFolderReader) nextBlock() error {
+	if len(c.sizes) == 0 {
+		if err := c.readBlock(); err != nil {
+			return err
+		}
+	}
+	uncompressed := c.sizes[0]
+	c.sizes = c.sizes[1:]
+
+	switch c.compression {
+	case cabCompressNone:
+		c.block, c.payload = c.payload, nil
+		if len(c.block) != uncompressed {
+			return fmt.Errorf("bad stored block")
+		}
+		return nil
+	case cabCompressLZX:
+		block, err := c.lzx.frame(uncompressed)
+		c.block = block
+		return err
+	}
+
+	block := c.payload
+	c.payload = nil
+	if len(block) < 2 || block[0] != 'C' || block[1] != 'K' {
+		return fmt.Errorf("bad MSZIP block")
+	}
+	out := make([]byte, uncompressed)
+	fr := flate.NewReaderDict(bytes.NewReader(block[2:]), c.window)
+	if _, err := io.ReadFull(fr, out); err != nil {
+		return fmt.Errorf("bad MSZIP block: %v", err)
+	}
+	c.window = append(c.window, out...)
+	if len(c.window) > 32768 {
+		c.window = c.window[len(c.window)-32768:]
+	}
+	c.block = out
+	return nil
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+// msiStreamKey encodes name the way MSI stream names are, the reverse of
+// msiStreamName
+func msiStreamKey(name string, table bool) []uint16 {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz._"
+	idx := func(c byte) uint16 { return uint16(bytes.IndexByte([]byte(chars), c)) }
+	var out []uint16
+	if table {
+		out = append(out, 0x4840)
+	}
+	for i := 0; i < len(name); i += 2 {
+		if i+1 < len(name) {
+			out = append(out, 0x3800+idx(name[i])+idx(name[i+1])<<6)
+		} else {
+			out = append(out, 0x4800+idx(name[i]))
+		}
+	}
+	return out
+}
+
+type testStringPool struct {
+	ids  map[string]int
+	strs []string
+}
+
+func (p *testStringPool) id(s string) int {
+	if s == "" {
+		return 0
+	}
+	if id, ok := p.ids[s]; ok {
+		return id
+	}
+	p.strs = append(p.strs, s)
+	p.ids[s] = len(p.strs)
+	return len(p.strs)
+}
+
+// msiTable writes rows of strings and ints column by column
+func msiTable(p *testStringPool, types []int, rows [][]interface{}) []byte {
+	var buf bytes.Buffer
+	for c, t := range types {
+		for _, r := range rows {
+			switch v := r[c].(type) {
+			case string:
+				binary.Write(&buf, binary.LittleEndian, uint16(p.id(v)))
+			case int:
+				if t&0xff <= 2 {
+					binary.Write(&buf, binary.LittleEndian, uint16(v+0x8000))
+				} else {
+					binary.Write(&buf, binary.LittleEndian, uint32(v+0x80000000))
+				}
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+type testStream struct {
+	name []uint16
+	data []byte
+}
+
+// compoundFileData writes a compound file with 512 byte sectors holding
+// streams in its root storage
+func compoundFileData(streams []testStream) []byte {
+	const sectorSize = 512
+	var sectors [][]byte
+	var fat []uint32
+	alloc := func(data []byte) uint32 {
+		if len(data) == 0 {
+			return cfbEndOfChain
+		}
+		start := uint32(len(sectors))
+		for off := 0; off < len(data); off += sectorSize {
+			sector := make([]byte, sectorSize)
+			copy(sector, data[off:])
+			sectors = append(sectors, sector)
+			fat = append(fat, uint32(len(sectors)))
+		}
+		fat[len(fat)-1] = cfbEndOfChain
+		return start
+	}
+
+	// small streams go in the mini stream
+	var mini bytes.Buffer
+	var miniFAT []uint32
+	starts := make([]uint32, len(streams))
+	for i, s := range streams {
+		if len(s.data) >= 4096 {
+			starts[i] = alloc(s.data)
+			continue
+		}
+		start := uint32(mini.Len() / 64)
+		starts[i] = start
+		n := (len(s.data) + 63) / 64
+		for j := 0; j < n; j++ {
+			miniFAT = append(miniFAT, start+uint32(j)+1)
+		}
+		if n > 0 {
+			miniFAT[len(miniFAT)-1] = cfbEndOfChain
+		}
+		mini.Write(s.data)
+		mini.Write(make([]byte, n*64-len(s.data)))
+	}
+	miniStart := alloc(mini.Bytes())
+	var miniFATData bytes.Buffer
+	binary.Write(&miniFATData, binary.LittleEndian, miniFAT)
+	miniFATStart := alloc(miniFATData.Bytes())
+
+	var dir bytes.Buffer
+	entry := func(name []uint16, typ uint8, start uint32, size int, right, child uint32) {
+		var e cfbDirEntry
+		copy(e.Name[:], name)
+		e.NameLen = uint16(2 * (len(name) + 1))
+		e.Type = typ
+		e.Left, e.Right, e.Child = cfbNoStream, right, child
+		e.StartSector, e.Size = start, uint64(size)
+		binary.Write(&dir, binary.LittleEndian, &e)
+	}
+	entry(utf16.Encode([]rune("Root Entry")), cfbTypeRoot, miniStart, mini.Len(), cfbNoStream, 1)
+	for i, s := range streams {
+		right := uint32(i + 2)
+		if i == len(streams)-1 {
+			right = cfbNoStream
+		}
+		entry(s.name, cfbTypeStream, starts[i], len(s.data), right, cfbNoStream)
+	}
+	dirStart := alloc(dir.Bytes())
+
+	numFAT := 1
+	for (len(sectors)+numFAT)*4 > numFAT*sectorSize {
+		numFAT++
+	}
+	var hdr cfbHeader
+	copy(hdr.Signature[:], magicCFB)
+	hdr.MinorVersion, hdr.MajorVersion, hdr.ByteOrder = 0x3e, 3, 0xfffe
+	hdr.SectorShift, hdr.MiniSectorShift = 9, 6
+	hdr.NumFATSectors = uint32(numFAT)
+	hdr.FirstDirSector = dirStart
+	hdr.MiniStreamCutoff = 4096
+	hdr.FirstMiniFATSect = miniFATStart
+	hdr.NumMiniFATSectors = 1
+	hdr.FirstDIFATSector = cfbEndOfChain
+	for i := range hdr.DIFAT {
+		hdr.DIFAT[i] = cfbFreeSect
+	}
+	for i := 0; i < numFAT; i++ {
+		hdr.DIFAT[i] = uint32(len(sectors) + i)
+		fat = append(fat, 0xfffffffd)
+	}
+	for len(fat)%(sectorSize/4) != 0 {
+		fat = append(fat, cfbFreeSect)
+	}
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, &hdr)
+	out.Write(make([]byte, sectorSize-out.Len()))
+	for _, s := range sectors {
+		out.Write(s)
+	}
+	binary.Write(&out, binary.LittleEndian, fat)
+	return out.Bytes()
+}
+
+type testCabFile struct {
+	name string
+	data []byte
+}
+
+type testCabFolder struct {
+	compression uint16
+	files       []testCabFile
+}
+
+// cabinetData writes a cabinet of folders
+func cabinetData(folders []testCabFolder) []byte {
+	var fileRecs bytes.Buffer
+	var data [][]byte
+	var numBlocks []int
+	numFiles := 0
+	for i, folder := range folders {
+		var all []byte
+		for _, f := range folder.files {
+			binary.Write(&fileRecs, binary.LittleEndian, cabFileHeader{
+				Size:         uint32(len(f.data)),
+				FolderOffset: uint32(len(all)),
+				Folder:       uint16(i),
+				Date:         0x5021,
+				Time:         0x6000,
+				Attribs:      0x20,
+			})
+			fileRecs.WriteString(f.name + "\x00")
+			all = append(all, f.data...)
+			numFiles++
+		}
+
+		var frames [][]byte
+		switch folder.compression & cabCompressMask {
+		case cabCompressLZX:
+			frames = lzxCompress(all, uint(folder.compression>>8), []lzxTestBlock{{lzxBlockAligned, len(all), 0}}, 0)
+		default:
+			var window []byte
+			for off := 0; off < len(all); off += lzxFrameSize {
+				end := off + lzxFrameSize
+				if end > len(all) {
+					end = len(all)
+				}
+				chunk := all[off:end]
+				if folder.compression == cabCompressNone {
+					frames = append(frames, chunk)
+					continue
+				}
+				var b bytes.Buffer
+				b.WriteString("CK")
+				w, _ := flate.NewWriterDict(&b, flate.BestCompression, window)
+				w.Write(chunk)
+				w.Close()
+				frames = append(frames, b.Bytes())
+				window = append(window, chunk...)
+				if len(window) > lzxFrameSize {
+					window = window[len(window)-lzxFrameSize:]
+				}
+			}
+		}
+		data = append(data, cabFolderData(frames, len(all)))
+		numBlocks = append(numBlocks, len(frames))
+	}
+
+	hdr := cabHeader{
+		VersionMinor: 3,
+		VersionMajor: 1,
+		NumFolders:   uint16(len(folders)),
+		NumFiles:     uint16(numFiles),
+	}
+	copy(hdr.Signature[:], magicCab)
+	hdr.FilesOffset = uint32(binary.Size(hdr) + binary.Size(cabFolder{})*len(folders))
+	offset := int(hdr.FilesOffset) + fileRecs.Len()
+	var folderRecs bytes.Buffer
+	for i, folder := range folders {
+		binary.Write(&folderRecs, binary.LittleEndian, cabFolder{uint32(offset), uint16(numBlocks[i]), folder.compression})
+		offset += len(data[i])
+	}
+	hdr.CabinetSize = uint32(offset)
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, &hdr)
+	out.Write(folderRecs.Bytes())
+	out.Write(fileRecs.Bytes())
+	for _, d := range data {
+		out.Write(d)
+	}
+	return out.Bytes()
+}
+
+var testBigFile = lzxTestData(100000)
+
+// msiData writes an installer with the files of a Go tree in a cabinet with
+// the given compression for each folder, and one file outside of it
+func msiData(compression ...uint16) []byte {
+	files := []testCabFile{
+		{"netA", []byte("net archive")},
+		{"readme", []byte("readme")},
+		{"bigF", testBigFile},
+		{"outside", []byte("x")},
+	}
+	var folders []testCabFolder
+	for i, c := range compression {
+		folder := testCabFolder{compression: c}
+		for j := i; j < len(files); j += len(compression) {
+			folder.files = append(folder.files, files[j])
+		}
+		folders = append(folders, folder)
+	}
+	cab := cabinetData(folders)
+
+	p := &testStringPool{ids: map[string]int{}}
+	const (
+		str = msiTypeValid | msiTypeString | 0x48
+		i2  = msiTypeValid | 0x0402
+		i4  = msiTypeValid | 0x0004
+		key = 0x2000
+		bin = msiTypeValid | msiTypeString | 0x0100 | msiTypeNullable
+	)
+	tables := []struct {
+		name  string
+		types []int
+		rows  [][]interface{}
+	}{
+		{"Directory", []int{str | key, str | msiTypeNullable, str}, [][]interface{}{
+			{"TARGETDIR", "", "SourceDir"},
+			{"INSTALLDIR", "TARGETDIR", "Go"},
+			{"PKG", "INSTALLDIR", "pkg"},
+			{"WIN", "PKG", "WINDOW~1|windows_amd64"},
+			{"OTHER", "TARGETDIR", "Other"},
+		}},
+		{"Component", []int{str | key, str | msiTypeNullable, str, i2, str | msiTypeNullable, str | msiTypeNullable}, [][]interface{}{
+			{"CWin", "", "WIN", 0, "", ""},
+			{"CRoot", "", "INSTALLDIR", 0, "", ""},
+			{"COther", "", "OTHER", 0, "", ""},
+		}},
+		{"File", []int{str | key, str, str, i4, str | msiTypeNullable, str | msiTypeNullable, i2 | msiTypeNullable, i2}, [][]interface{}{
+			{"netA", "CWin", "net.a", 11, "", "", 0, 1},
+			{"readme", "CRoot", "README~1|README.md", 6, "", "", 0, 2},
+			{"bigF", "CWin", "big.a", len(testBigFile), "", "", 0, 3},
+			{"outside", "COther", "x.txt", 1, "", "", 0, 4},
+		}},
+		// binary columns are stream references, not strings
+		{"Binary", []int{str | key, bin}, [][]interface{}{{"icon", 0}}},
+	}
+
+	var columns [][]interface{}
+	for _, t := range tables {
+		for i, typ := range t.types {
+			columns = append(columns, []interface{}{t.name, i + 1, "Col" + string(rune('A'+i)), typ})
+		}
+	}
+	streams := []testStream{
+		{msiStreamKey("_Columns", true), msiTable(p, []int{str, i2, str, i2}, columns)},
+	}
+	for _, t := range tables {
+		streams = append(streams, testStream{msiStreamKey(t.name, true), msiTable(p, t.types, t.rows)})
+	}
+	var pool, strs bytes.Buffer
+	binary.Write(&pool, binary.LittleEndian, []uint16{1252, 0})
+	for _, s := range p.strs {
+		binary.Write(&pool, binary.LittleEndian, []uint16{uint16(len(s)), 1})
+		strs.WriteString(s)
+	}
+	streams = append(streams,
+		testStream{msiStreamKey("_StringPool", true), pool.Bytes()},
+		testStream{msiStreamKey("_StringData", true), strs.Bytes()},
+		testStream{msiStreamKey("go.cab", false), cab},
+		testStream{utf16.Encode([]rune("\x05SummaryInformation")), make([]byte, 100)},
+	)
+	return compoundFileData(streams)
+}
+
+func TestUnpackMsi(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression []uint16
+	}{
+		{"stored", []uint16{cabCompressNone}},
+		{"MSZIP", []uint16{cabCompressZip}},
+		{"LZX", []uint16{cabCompressLZX | 16<<8}},
+		{"mixed", []uint16{cabCompressZip, cabCompressLZX | 21<<8, cabCompressNone}},
+	}
+	for _, tt := range tests {
+		tmp, err := ioutil.TempDir("", "msi-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		installer := filepath.Join(tmp, "go.msi")
+		if err := ioutil.WriteFile(installer, msiData(tt.compression...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(installer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		dest := filepath.Join(tmp, "dest")
+		if err := unpackArchive(context.Background(), dest, f, nil); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for name, want := range map[string]string{
+			"go/pkg/windows_amd64/net.a": "net archive",
+			"go/README.md":               "readme",
+			"go/pkg/windows_amd64/big.a": string(testBigFile),
+		} {
+			if got := readTestFile(t, filepath.Join(dest, filepath.FromSlash(name))); got != want {
+				t.Errorf("%s: %s has %d bytes, want %d", tt.name, name, len(got), len(want))
+			}
+		}
+		if entries, _ := ioutil.ReadDir(dest); len(entries) != 1 || entries[0].Name() != "go" {
+			t.Errorf("%s: extracted files outside of the Go tree", tt.name)
+		}
+	}
+}
+
+func TestUnpackCabTruncated(t *testing.T) {
+	cab := cabinetData([]testCabFolder{{cabCompressLZX | 16<<8, []testCabFile{{"bigF", testBigFile}}}})
+	dest, err := ioutil.TempDir("", "msi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	x, err := newExtractor(context.Background(), dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]string{"bigF": "go/big.a"}
+	for _, n := range []int{20, 60, len(cab) / 2, len(cab) - 1} {
+		if err := unpackCab(x, bytes.NewReader(cab[:n]), paths); err == nil {
+			t.Errorf("cabinet cut at %d bytes unpacked without error", n)
+		}
+	}
+}
+
+func TestOpenCompoundFileBadFATCount(t *testing.T) {
+	data := msiData(cabCompressNone)
+	// NumFATSectors, far more than the file has
+	binary.LittleEndian.PutUint32(data[44:], 0xffffffff)
+	if _, err := openCompoundFile(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("compound file with 2^32-1 FAT sectors opened without error")
+	}
+}
+
+// real installers and cabinets rather than ones written by the tests, see
+// testdata/README.md
+func TestUnpackCabFixtures(t *testing.T) {
+	msi, err := os.Open(filepath.Join("testdata", "dummy.msi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msi.Close()
+	fi, err := msi.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := openCompoundFile(msi, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openMsiDatabase(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dummy installs to Program Files, not a Go tree
+	if paths, err := db.filePaths(); err != nil || len(paths) != 0 {
+		t.Errorf("got Go tree paths %v, %v", paths, err)
+	}
+	embedded, err := cf.stream(string(utf16.Decode(msiStreamKey("product.cab", false))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cab, err := os.Open(filepath.Join("testdata", "dummy.cab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cab.Close()
+
+	tests := []struct {
+		name   string
+		cab    io.Reader
+		key    string
+		size   int
+		sha256 string
+	}{
+		{"dummy.msi", embedded, "EXE", 4608, "9842031d9f433466e60fbd6eed6f1c13b13cc3e825b922ebc442f861cea90ea0"},
+		{"dummy.cab", cab, "dummy.wxs", 1186, "a1a2dbdd3a82ccf203e844e496dc3be64e906cc3d312eb3a8436e3108935492b"},
+	}
+	for _, tt := range tests {
+		dest, err := ioutil.TempDir("", "msi-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+		x, err := newExtractor(context.Background(), dest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unpackCab(x, tt.cab, map[string]string{tt.key: "go/" + tt.key}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := readTestFile(t, filepath.Join(dest, "go", tt.key))
+		sum := sha256.Sum256([]byte(got))
+		if len(got) != tt.size || hex.EncodeToString(sum[:]) != tt.sha256 {
+			t.Errorf("%s: %s has %d bytes with SHA-256 %x, want %d bytes with %s", tt.name, tt.key, len(got), sum, tt.size, tt.sha256)
+		}
+	}
+}
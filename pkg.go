@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Support for darwin .pkg installers: a xar archive which holds the installed
+// files as a gzipped cpio archive called Payload.
+
+var magicXar = []byte("xar!")
+
+type xarHeader struct {
+	Magic             uint32
+	Size              uint16
+	Version           uint16
+	TocCompressed     uint64
+	TocUncompressed   uint64
+	ChecksumAlgorithm uint32
+}
+
+type xarFile struct {
+	Name  string    `xml:"name"`
+	Type  string    `xml:"type"`
+	Data  *xarData  `xml:"data"`
+	Files []xarFile `xml:"file"`
+}
+
+type xarData struct {
+	Offset   int64 `xml:"offset"`
+	Length   int64 `xml:"length"`
+	Encoding struct {
+		Style string `xml:"style,attr"`
+	} `xml:"encoding"`
+}
+
+type xarTOC struct {
+	Files []xarFile `xml:"toc>file"`
+}
+
+// unpackPkg extracts the parts of the Go tree that pass filter from a darwin
+// installer package
+func unpackPkg(ctx context.Context, dest string, r *os.File, filter *extractFilter) error {
+	var hdr xarHeader
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if _, err := r.Seek(int64(hdr.Size), io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := zlib.NewReader(io.LimitReader(r, int64(hdr.TocCompressed)))
+	if err != nil {
+		return fmt.Errorf("bad xar table of contents: %v", err)
+	}
+	var toc xarTOC
+	if err := xml.NewDecoder(zr).Decode(&toc); err != nil {
+		return fmt.Errorf("bad xar table of contents: %v", err)
+	}
+	heap := int64(hdr.Size) + int64(hdr.TocCompressed)
+
+	payloads := findPayloads(toc.Files)
+	if len(payloads) == 0 {
+		return fmt.Errorf("installer package has no Payload")
+	}
+	x, err := newExtractor(ctx, dest, filter)
+	if err != nil {
+		return err
+	}
+	for _, data := range payloads {
+		rd, err := xarDataReader(r, heap, data)
+		if err != nil {
+			return err
+		}
+		if err := unpackPayload(x, rd); err != nil {
+			return err
+		}
+	}
+	return x.Close()
+}
+
+// findPayloads returns the data of all files named Payload in the TOC, one
+// for each package in the installer
+func findPayloads(files []xarFile) (payloads []*xarData) {
+	for _, f := range files {
+		if f.Name == "Payload" && f.Type == "file" && f.Data != nil {
+			payloads = append(payloads, f.Data)
+		}
+		payloads = append(payloads, findPayloads(f.Files)...)
+	}
+	return
+}
+
+// xarDataReader returns the decoded contents of a file in the xar heap
+func xarDataReader(r *os.File, heap int64, data *xarData) (io.Reader, error) {
+	rd := io.NewSectionReader(r, heap+data.Offset, data.Length)
+	switch data.Encoding.Style {
+	case "", "application/octet-stream":
+		return rd, nil
+	case "application/x-gzip":
+		// despite the name, xar uses zlib streams
+		return zlib.NewReader(rd)
+	case "application/x-bzip2":
+		return bzip2.NewReader(rd), nil
+	}
+	return nil, fmt.Errorf("unsupported xar encoding: %s", data.Encoding.Style)
+}
+
+// unpackPayload extracts the Go tree from a gzipped cpio Payload
+func unpackPayload(x *extractor, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == magicGzip[0] && magic[1] == magicGzip[1] {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		br = bufio.NewReader(gr)
+	}
+	cr := &cpioReader{r: br}
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name, ok := installedGoPath(hdr.Name)
+		// the package also installs /etc/paths.d/go, which isn't the Go tree
+		if !ok || name == "go" && hdr.Mode&cpioTypeMask != cpioTypeDir || !x.Wants(name) {
+			continue
+		}
+		switch hdr.Mode & cpioTypeMask {
+		case cpioTypeDir:
+			err = x.Dir(name, os.FileMode(hdr.Mode).Perm(), hdr.ModTime)
+		case cpioTypeReg:
+			err = x.File(name, cr, os.FileMode(hdr.Mode).Perm(), hdr.ModTime)
+		case cpioTypeSymlink:
+			var target []byte
+			if target, err = readAllLimit(cr, 4096); err == nil {
+				err = x.Symlink(name, string(target))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// installedGoPath maps the path a file is installed to by a package, like
+// ./usr/local/go/pkg/darwin_amd64/net.a or Go\pkg\windows_386\net.a, to its
+// path in the distribution archives, go/pkg/... Paths outside the Go tree
+// are not part of it.
+func installedGoPath(name string) (string, bool) {
+	parts := strings.Split(strings.Replace(name, `\`, "/", -1), "/")
+	for i, part := range parts {
+		if strings.EqualFold(part, "go") {
+			return path.Join(append([]string{"go"}, parts[i+1:]...)...), true
+		}
+	}
+	return "", false
+}
+
+func readAllLimit(r io.Reader, limit int64) ([]byte, error) {
+	b := make([]byte, limit)
+	n, err := io.ReadFull(r, b)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	} else if err == nil {
+		err = fmt.Errorf("value longer than %d bytes", limit)
+	}
+	return b[:n], err
+}
+
+// cpio file types
+const (
+	cpioTypeMask    = 0170000
+	cpioTypeDir     = 0040000
+	cpioTypeReg     = 0100000
+	cpioTypeSymlink = 0120000
+)
+
+type cpioHeader struct {
+	Name    string
+	Mode    int64
+	Size    int64
+	ModTime time.Time
+}
+
+// cpioReader reads cpio archives in the portable ASCII (odc) format written
+// by pkgbuild and the newc format
+type cpioReader struct {
+	r *bufio.Reader
+
+	// unread bytes of the current entry and padding after it
+	remaining int64
+	pad       int64
+}
+
+func (c *cpioReader) Next() (*cpioHeader, error) {
+	if _, err := io.CopyN(ioutil.Discard, c.r, c.remaining+c.pad); err != nil {
+		return nil, err
+	}
+	c.remaining, c.pad = 0, 0
+
+	magic := make([]byte, 6)
+	if _, err := io.ReadFull(c.r, magic); err != nil {
+		return nil, err
+	}
+
+	var hdr cpioHeader
+	var nameSize int64
+	var err error
+	switch string(magic) {
+	case "070707":
+		// dev ino mode uid gid nlink rdev mtime namesize filesize, in octal
+		f, ferr := c.fields([]int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}, 8)
+		if ferr != nil {
+			return nil, ferr
+		}
+		hdr.Mode, hdr.ModTime, nameSize, hdr.Size = f[2], time.Unix(f[7], 0), f[8], f[9]
+		hdr.Name, err = c.name(nameSize, 0)
+	case "070701", "070702":
+		// ino mode uid gid nlink mtime filesize devmajor devminor rdevmajor
+		// rdevminor namesize check, in hex and padded to 4 bytes
+		widths := make([]int, 13)
+		for i := range widths {
+			widths[i] = 8
+		}
+		f, ferr := c.fields(widths, 16)
+		if ferr != nil {
+			return nil, ferr
+		}
+		hdr.Mode, hdr.ModTime, hdr.Size, nameSize = f[1], time.Unix(f[5], 0), f[6], f[11]
+		hdr.Name, err = c.name(nameSize, (4-(110+nameSize)%4)%4)
+		c.pad = (4 - hdr.Size%4) % 4
+	default:
+		return nil, fmt.Errorf("bad cpio header magic %q", magic)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name == "TRAILER!!!" {
+		return nil, io.EOF
+	}
+	c.remaining = hdr.Size
+	return &hdr, nil
+}
+
+func (c *cpioReader) fields(widths []int, base int) ([]int64, error) {
+	vals := make([]int64, len(widths))
+	for i, w := range widths {
+		b := make([]byte, w)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseInt(string(b), base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad cpio header: %v", err)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func (c *cpioReader) name(size, pad int64) (string, error) {
+	if size <= 0 || size > 4096 {
+		return "", fmt.Errorf("bad cpio name size: %d", size)
+	}
+	b := make([]byte, size+pad)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b[:size]), "\x00"), nil
+}
+
+func (c *cpioReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
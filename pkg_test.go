@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type cpioTestEntry struct {
+	name     string
+	mode     int64
+	contents string
+}
+
+// cpioData writes entries as an odc cpio archive like pkgbuild does, or as
+// newc
+func cpioData(newc bool, entries ...cpioTestEntry) []byte {
+	var buf bytes.Buffer
+	entries = append(entries, cpioTestEntry{"TRAILER!!!", 0, ""})
+	for i, e := range entries {
+		name := e.name + "\x00"
+		if !newc {
+			fmt.Fprintf(&buf, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o",
+				0, i, e.mode, 0, 0, 1, 0, testModTime.Unix(), len(name), len(e.contents))
+			buf.WriteString(name)
+			buf.WriteString(e.contents)
+			continue
+		}
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			i, e.mode, 0, 0, 1, testModTime.Unix(), len(e.contents), 0, 0, 0, 0, len(name), 0)
+		buf.WriteString(name)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+		buf.WriteString(e.contents)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+	}
+	return buf.Bytes()
+}
+
+// pkgData writes a xar archive with a Payload for each package, stored as
+// it is
+func pkgData(t *testing.T, payloads ...[]byte) []byte {
+	var heap, toc bytes.Buffer
+	toc.WriteString("<?xml version=\"1.0\"?><xar><toc>")
+	for i, p := range payloads {
+		fmt.Fprintf(&toc, "<file id=\"%d\"><name>go%d.pkg</name><type>directory</type>", 2*i+1, i)
+		fmt.Fprintf(&toc, "<file id=\"%d\"><name>Payload</name><type>file</type>", 2*i+2)
+		fmt.Fprintf(&toc, "<data><offset>%d</offset><length>%d</length><size>%d</size>", heap.Len(), len(p), len(p))
+		toc.WriteString("<encoding style=\"application/octet-stream\"/></data></file></file>")
+		heap.Write(p)
+	}
+	toc.WriteString("</toc></xar>")
+
+	var ztoc bytes.Buffer
+	zw := zlib.NewWriter(&ztoc)
+	zw.Write(toc.Bytes())
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	hdr := xarHeader{
+		Size:            28,
+		Version:         1,
+		TocCompressed:   uint64(ztoc.Len()),
+		TocUncompressed: uint64(toc.Len()),
+	}
+	hdr.Magic = binary.BigEndian.Uint32(magicXar)
+	binary.Write(&out, binary.BigEndian, &hdr)
+	out.Write(ztoc.Bytes())
+	out.Write(heap.Bytes())
+	return out.Bytes()
+}
+
+func TestUnpackPkg(t *testing.T) {
+	var payload bytes.Buffer
+	gw := gzip.NewWriter(&payload)
+	gw.Write(cpioData(false,
+		cpioTestEntry{".", 040755, ""},
+		cpioTestEntry{"./usr/local/go", 040755, ""},
+		cpioTestEntry{"./usr/local/go/VERSION", 0100644, "go1.4.3"},
+		cpioTestEntry{"./usr/local/go/bin", 040750, ""},
+		cpioTestEntry{"./usr/local/go/bin/gofmt", 0120755, "../pkg/tool/gofmt"},
+	))
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a second package with files outside the Go tree, like /etc/paths.d/go
+	other := cpioData(true,
+		cpioTestEntry{"./etc/paths.d/go", 0100644, "/usr/local/go/bin"},
+		cpioTestEntry{"./usr/local/go/pkg/darwin_amd64/net.a", 0100644, "net"},
+	)
+
+	tmp, err := ioutil.TempDir("", "pkg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	pkg := filepath.Join(tmp, "go.pkg")
+	if err := ioutil.WriteFile(pkg, pkgData(t, payload.Bytes(), other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dest := filepath.Join(tmp, "dest")
+	if err := unpackArchive(context.Background(), dest, f, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(dest, "go", "VERSION")); got != "go1.4.3" {
+		t.Errorf("VERSION has %q, want %q", got, "go1.4.3")
+	}
+	if got := readTestFile(t, filepath.Join(dest, "go", "pkg", "darwin_amd64", "net.a")); got != "net" {
+		t.Errorf("newc file has %q, want %q", got, "net")
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "go", "bin", "gofmt")); err != nil || target != "../pkg/tool/gofmt" {
+		t.Errorf("symlink points to %q, %v", target, err)
+	}
+	fi, err := os.Stat(filepath.Join(dest, "go", "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 || !fi.ModTime().Equal(testModTime) {
+		t.Errorf("bin has mode %v and mod time %v, want %v and %v", fi.Mode().Perm(), fi.ModTime(), os.FileMode(0750), testModTime)
+	}
+	if entries, _ := ioutil.ReadDir(dest); len(entries) != 1 || entries[0].Name() != "go" {
+		t.Errorf("extracted files outside of the Go tree")
+	}
+}
+
+func TestUnpackPkgTruncatedPayload(t *testing.T) {
+	payload := cpioData(false, cpioTestEntry{"./usr/local/go/VERSION", 0100644, "go1.4.3"})
+	tmp, err := ioutil.TempDir("", "pkg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	pkg := filepath.Join(tmp, "go.pkg")
+	if err := ioutil.WriteFile(pkg, pkgData(t, payload[:len(payload)-30]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unpackArchive(context.Background(), filepath.Join(tmp, "dest"), f, nil); err == nil {
+		t.Error("truncated payload unpacked without error")
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"io"
+	"hash"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/inconshreveable/log15"
@@ -25,10 +27,13 @@ var defaultPlatforms = []Platform{
 }
 
 const (
-	oldDistURL           = "https://go.googlecode.com/files/go%s.%s.tar.gz"
-	distURL              = "https://storage.googleapis.com/golang/go%s.%s.tar.gz"
-	lastOldDistVersion   = "1.2.1"
-	lastOldDarwinVersion = "1.4.2"
+	oldDistURL = "https://go.googlecode.com/files/go%s.%s.tar.gz"
+	distURL    = "https://storage.googleapis.com/golang/go%s.%s.tar.gz"
+)
+
+var (
+	lastOldDistVersion   = mustParseGoVersion("1.2.1")
+	lastOldDarwinVersion = mustParseGoVersion("1.4.2")
 )
 
 type Platform struct {
@@ -43,63 +48,149 @@ func (p *Platform) String() string {
 	return p.OS + "_" + p.Arch
 }
 
-func (p *Platform) Download(version string) (path string, err error) {
-	url := p.distURL(version)
-	lg := Log.New("plat", p.String(), "url", url)
-	lg.Info("start download")
-	resp, err := http.Get(url)
-	if err != nil {
-		return
+// Download fetches the platform's distribution and extracts the entries that
+// pass filter into a new temporary directory whose path it returns
+func (p *Platform) Download(ctx context.Context, opts *Options, filter *extractFilter) (path string, v Verification, err error) {
+	// a local distribution directory or a mirror may have the archive in
+	// any format, of the directory's files use the first one
+	anyFormat := opts.DistDir != "" || opts.Mirror != ""
+	urls := p.distURLs(opts.Version, opts.Mirror, anyFormat)
+	if opts.DistDir != "" {
+		if url, ok := findDistFile(opts.DistDir, urls); ok {
+			urls = []string{url}
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Bad response for download (%s): %v", url, resp.StatusCode)
+	for i, url := range urls {
+		path, v, err = p.download(ctx, opts, url, filter)
+		if err == nil || i == len(urls)-1 || !isNotFound(err) {
+			break
+		}
+		Log.Info("no archive for platform, trying the next one", "plat", p.String(), "url", url, "err", err)
+	}
+	return
+}
+
+// download fetches the distribution at url from the local distribution
+// directory, the cache or the network and unpacks it into a new temporary
+// directory
+func (p *Platform) download(ctx context.Context, opts *Options, url string, filter *extractFilter) (dir string, v Verification, err error) {
+	lg := Log.New("plat", p.String(), "url", url)
+	v = Verification{Platform: *p, URL: url}
+	v.Expected, v.Source = checksumFor(url)
+	if opts.RequireChecksum && (v.Expected == "" || weakChecksum(v.Expected)) {
+		lg.Error("no SHA-256 checksum for URL", "known", v.Expected)
+		return "", v, fmt.Errorf("No SHA-256 checksum known for %s and checksums are required, add it with -checksums", url)
 	}
 
-	archive, err := download(lg, resp.Body, p.String(), checksums[url])
+	dir, err = ioutil.TempDir(opts.WorkDir, p.String()+"-")
 	if err != nil {
-		return "", err
+		return "", v, err
 	}
-	defer os.Remove(archive.Name())
-	defer archive.Close()
-	if _, err := archive.Seek(0, os.SEEK_SET); err != nil {
-		return "", err
+	defer func() {
+		if err != nil {
+			lg.Error("unpack error", "err", err)
+			os.RemoveAll(dir)
+			dir = ""
+		}
+	}()
+
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir()
+	}
+	if opts.NoCache {
+		cacheDir = ""
 	}
 
-	path, err = ioutil.TempDir(".", p.String()+"-")
-	if err != nil {
-		return
+	// tarballs are unpacked as they download
+	if opts.DistDir == "" && streamable(url) {
+		if err = os.Remove(dir); err != nil {
+			return
+		}
+		if err = fetchStream(ctx, lg, newDownloader(opts), url, cacheDir, dir, filter, &v); err != nil {
+			return
+		}
+		lg.Info("download complete")
+		return dir, v, nil
 	}
-	var unpackFn func(string, *os.File) error
+
+	var archive *os.File
 	switch {
-	case strings.HasSuffix(url, ".zip"):
-		unpackFn = unpackZip
-	case strings.HasSuffix(url, ".tar.gz"):
-		unpackFn = unpackTarGz
+	case opts.DistDir != "":
+		archive, err = openDistFile(lg, opts.DistDir, path.Base(url), &v)
+	case cacheDir == "":
+		archive, err = newDownloader(opts).download(ctx, lg, url, opts.WorkDir, path.Base(url), &v)
+		if err == nil {
+			v.Origin = "download"
+			defer os.Remove(archive.Name())
+		}
 	default:
-		return "", fmt.Errorf("Unknown archive type for URL: %v", url)
+		archive, err = fetch(ctx, lg, newDownloader(opts), url, cacheDir, &v)
 	}
-
-	if err := unpackFn(path, archive); err != nil {
-		lg.Error("unpack error", "err", err)
-		return "", err
+	if err != nil {
+		return
+	}
+	defer archive.Close()
+	if _, err = archive.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	if err = unpackArchive(ctx, dir, archive, filter); err != nil {
+		return
 	}
 
 	lg.Info("download complete")
-	return path, nil
+	return dir, v, nil
+}
+
+// archive formats a local distribution directory or a mirror may have a
+// distribution in, in the order they are tried. The download site only uses
+// .tar.gz and .zip, but detectArchive tells all of them apart by their
+// contents anyway.
+var distExtensions = []string{".tar.gz", ".tar.xz", ".tar.zst", ".tar.bz2", ".tar", ".zip"}
+
+// distURLs returns the URLs to try in turn for the distribution of version:
+// the archive, in every one of distExtensions if anyFormat is set, then the
+// installer if the platform has one. Some releases only have installers for
+// a platform.
+func (p *Platform) distURLs(version GoVersion, mirror string, anyFormat bool) []string {
+	url := p.distURL(version, mirror)
+	urls := []string{url}
+	if anyFormat {
+		base := url
+		for _, ext := range distExtensions {
+			if strings.HasSuffix(url, ext) {
+				base = strings.TrimSuffix(url, ext)
+				break
+			}
+		}
+		urls = urls[:0]
+		for _, ext := range distExtensions {
+			urls = append(urls, base+ext)
+		}
+	}
+	if url := p.installerURL(version, mirror); url != "" {
+		urls = append(urls, url)
+	}
+	return urls
 }
 
-func (p *Platform) distURL(version string) string {
+// distURL returns the download URL of the distribution for version. If mirror
+// is set, it replaces the official download location but the file names stay
+// the same.
+func (p *Platform) distURL(version GoVersion, mirror string) string {
 	template := distURL
-	if version <= lastOldDistVersion {
+	if version.AtMost(lastOldDistVersion) {
 		template = oldDistURL
 	}
+	if mirror != "" {
+		template = strings.TrimRight(mirror, "/") + "/go%s.%s.tar.gz"
+	}
 
 	distString := p.OS + "-" + p.Arch
 	// special cases
 	switch {
-	case p.OS == "darwin" && version <= lastOldDarwinVersion:
+	case p.OS == "darwin" && version.AtMost(lastOldDarwinVersion):
 		distString += "-osx10.8"
 	case p.OS == "" && p.Arch == "":
 		distString = "src"
@@ -112,31 +203,49 @@ func (p *Platform) distURL(version string) string {
 	return s
 }
 
-func download(lg log15.Logger, rd io.Reader, name string, checksum string) (*os.File, error) {
-	f, err := ioutil.TempFile(".", name+"-")
-	if err != nil {
-		return nil, err
+// installerURL returns the download URL of the installer package for
+// version, or an empty string if the platform has none
+func (p *Platform) installerURL(version GoVersion, mirror string) string {
+	url := p.distURL(version, mirror)
+	switch p.OS {
+	case "darwin":
+		return strings.TrimSuffix(url, ".tar.gz") + ".pkg"
+	case "windows":
+		return strings.TrimSuffix(url, ".zip") + ".msi"
 	}
-	defer func() {
-		if err != nil {
-			f.Close()
-			os.Remove(f.Name())
-		}
-	}()
-	sha := sha1.New()
-	wr := io.MultiWriter(f, sha)
-	if _, err := io.Copy(wr, rd); err != nil {
-		return nil, err
+	return ""
+}
+
+// verifyDigest compares the digest recorded in v with the expected one
+func verifyDigest(lg log15.Logger, v *Verification) error {
+	if v.Expected == "" {
+		lg.Warn("no checksum for URL", v.Algo, v.Digest)
+	} else if v.Digest != strings.ToLower(v.Expected) {
+		lg.Error("checksum mismatch", "algo", v.Algo, "expected", v.Expected, "got", v.Digest)
+		return fmt.Errorf("%s checksum mismatch: expected %s, got %s", v.Algo, v.Expected, v.Digest)
+	}
+	return nil
+}
+
+// checksumHash picks the hash algorithm for a hex-encoded checksum by its
+// length. Everything is verified with SHA-256 except the entries for older
+// releases which were only ever published with SHA-1 sums.
+func checksumHash(checksum string) (algo string, h hash.Hash, err error) {
+	if _, err := hex.DecodeString(checksum); err != nil {
+		return "", nil, fmt.Errorf("Malformed checksum %q: %v", checksum, err)
 	}
-	if checksum == "" {
-		lg.Warn("no checksum for URL")
-	} else if actual := hex.EncodeToString(sha.Sum(nil)); actual != checksum {
-		lg.Error("checksum mismatch", "expected", checksum, "got", actual)
-		return nil, fmt.Errorf("checksum mismatch: %v/%v", actual, checksum)
+	switch len(checksum) {
+	case 0, sha256.Size * 2:
+		return "sha256", sha256.New(), nil
+	case sha1.Size * 2:
+		return "sha1", sha1.New(), nil
+	default:
+		return "", nil, fmt.Errorf("Malformed checksum %q: not a SHA-256 or SHA-1 hex digest", checksum)
 	}
-	return f, nil
 }
 
+// checksums maps distribution URLs to the hex digests of their archives.
+// New entries should be SHA-256; the SHA-1 entries are kept for old releases.
 var checksums = map[string]string{
 	"https://storage.googleapis.com/golang/go1.5.2.src.tar.gz":                     "c7d78ba4df574b5f9a9bb5d17505f40c4d89b81c",
 	"https://storage.googleapis.com/golang/go1.5.2.darwin-amd64.tar.gz":            "4f30332a56e9c8a36daeeff667bab3608e4dffd2",
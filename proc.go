@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// how long to wait for the output of a killed command's children, which may
+// hold on to its stdout and stderr
+const killWaitDelay = 5 * time.Second
+
+// groupCommand is exec.CommandContext for commands that start commands of
+// their own, like make.bash and dist. When ctx is done, it kills all of them
+// and not just the command itself, where the platform allows it.
+func groupCommand(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = killWaitDelay
+	return cmd
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestGroupCommandKillsChildren(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// the background sleep holds on to stdout like a compiler started by
+	// make.bash would, so waiting for the command takes until it exits
+	// unless it's killed as well
+	cmd := groupCommand(ctx, "sh", "-c", "sleep 60 & wait")
+	cmd.Stdout = ioutil.Discard
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	if err := cmd.Wait(); err == nil {
+		t.Error("canceled command succeeded")
+	}
+	if d := time.Since(start); d >= killWaitDelay {
+		t.Errorf("waited %v for the children of the canceled command", d)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/inconshreveable/log15/term"
+)
+
+// progress tracks how far along one long running task (a download or a copy) is
+type progress struct {
+	name  string
+	bytes bool
+	start time.Time
+
+	// accessed atomically
+	done     int64
+	total    int64
+	finished int32
+}
+
+// Add records n more bytes or files as done
+func (p *progress) Add(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.done, n)
+	}
+}
+
+// Write counts the bytes written to it so a progress can be used with io.MultiWriter
+func (p *progress) Write(b []byte) (int, error) {
+	p.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// SetTotal sets the amount of work the task has, <= 0 if unknown
+func (p *progress) SetTotal(total int64) {
+	if p != nil {
+		atomic.StoreInt64(&p.total, total)
+	}
+}
+
+// Set records exactly n bytes or files as done, e.g. when a download starts over
+func (p *progress) Set(n int64) {
+	if p != nil {
+		atomic.StoreInt64(&p.done, n)
+	}
+}
+
+// Finish marks the task as done so it is no longer reported
+func (p *progress) Finish() {
+	if p != nil {
+		atomic.StoreInt32(&p.finished, 1)
+	}
+}
+
+// rate returns the average throughput so far in bytes per second
+func (p *progress) rate() string {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return ""
+	}
+	return formatBytes(int64(float64(atomic.LoadInt64(&p.done))/elapsed)) + "/s"
+}
+
+func (p *progress) String() string {
+	done, total := atomic.LoadInt64(&p.done), atomic.LoadInt64(&p.total)
+	if !p.bytes {
+		if total > 0 {
+			return fmt.Sprintf("%-28s %d/%d files", p.name, done, total)
+		}
+		return fmt.Sprintf("%-28s %d files", p.name, done)
+	}
+	if total > 0 {
+		return fmt.Sprintf("%-28s %9s / %-9s %5.1f%% %11s", p.name, formatBytes(done), formatBytes(total), 100*float64(done)/float64(total), p.rate())
+	}
+	return fmt.Sprintf("%-28s %9s %11s", p.name, formatBytes(done), p.rate())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressReporter periodically shows the progress of all running tasks. On
+// a terminal it redraws them as a live multi-line display, otherwise it logs
+// them. Log messages and the output of commands written through Writer are
+// shown above the live display instead of being drawn over.
+type progressReporter struct {
+	mu       sync.Mutex
+	tasks    []*progress
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	drawn    int
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// the log handler the reporter took the place of
+	logHandler log.Handler
+
+	// set while the terminal's cursor is in the middle of a line of output,
+	// where the display can't be drawn
+	midLine bool
+}
+
+// progressDisplay reports the progress of the running build, nil if there is none
+var progressDisplay *progressReporter
+
+// startProgress begins reporting progress to stderr
+func startProgress() *progressReporter {
+	r := &progressReporter{
+		out:      os.Stderr,
+		tty:      term.IsTty(os.Stderr.Fd()),
+		interval: 10 * time.Second,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if r.tty {
+		r.interval = 250 * time.Millisecond
+		r.logHandler = Log.GetHandler()
+		Log.SetHandler(&progressLogHandler{r})
+	}
+	go r.run()
+	return r
+}
+
+// Writer returns a writer for output to w, the terminal, while progress is
+// reported. It is safe to call on a nil reporter in which case it returns w.
+func (r *progressReporter) Writer(w io.Writer) io.Writer {
+	if r == nil || !r.tty {
+		return w
+	}
+	return &progressWriter{r, w}
+}
+
+// progressWriter clears the live display for each write and redraws it below
+// what was written
+type progressWriter struct {
+	r *progressReporter
+	w io.Writer
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.r.mu.Lock()
+	defer pw.r.mu.Unlock()
+	pw.r.clear()
+	n, err := pw.w.Write(p)
+	if n > 0 {
+		pw.r.midLine = p[n-1] != '\n'
+	}
+	pw.r.draw()
+	return n, err
+}
+
+// progressLogHandler passes log records on to the handler the reporter
+// replaced, clearing the live display for them like progressWriter
+type progressLogHandler struct {
+	r *progressReporter
+}
+
+func (h *progressLogHandler) Log(rec *log.Record) error {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	h.r.clear()
+	err := h.r.logHandler.Log(rec)
+	h.r.draw()
+	return err
+}
+
+// Track starts tracking a new task. It is safe to call on a nil reporter in
+// which case the returned progress is nil and ignores all updates.
+func (r *progressReporter) Track(name string, bytes bool) *progress {
+	if r == nil {
+		return nil
+	}
+	p := &progress{name: name, bytes: bytes, start: time.Now()}
+	r.mu.Lock()
+	r.tasks = append(r.tasks, p)
+	r.mu.Unlock()
+	return p
+}
+
+// Stop stops reporting and clears the live display. It may be called more
+// than once.
+func (r *progressReporter) Stop() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.stopped
+}
+
+func (r *progressReporter) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-r.stop:
+			r.mu.Lock()
+			r.clear()
+			if r.logHandler != nil {
+				Log.SetHandler(r.logHandler)
+			}
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// report shows all unfinished tasks and forgets about the finished ones
+func (r *progressReporter) report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	running := r.tasks[:0]
+	for _, p := range r.tasks {
+		if atomic.LoadInt32(&p.finished) == 0 {
+			running = append(running, p)
+		}
+	}
+	r.tasks = running
+
+	if !r.tty {
+		for _, p := range running {
+			ctx := []interface{}{"task", p.name, "done", atomic.LoadInt64(&p.done), "total", atomic.LoadInt64(&p.total)}
+			if p.bytes {
+				ctx = append(ctx, "rate", p.rate())
+			}
+			Log.Info("progress", ctx...)
+		}
+		return
+	}
+
+	r.clear()
+	r.draw()
+}
+
+// draw shows the running tasks below the cursor, unless it is in the middle
+// of a line. r.mu must be held and the previous display cleared.
+func (r *progressReporter) draw() {
+	if r.midLine {
+		return
+	}
+	for _, p := range r.tasks {
+		if atomic.LoadInt32(&p.finished) == 0 {
+			fmt.Fprintln(r.out, p.String())
+			r.drawn++
+		}
+	}
+}
+
+// clear erases the lines drawn by the last report
+func (r *progressReporter) clear() {
+	for ; r.drawn > 0; r.drawn-- {
+		fmt.Fprint(r.out, "\x1b[1A\x1b[2K")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var out bytes.Buffer
+	r := &progressReporter{out: &out, tty: true}
+	p := r.Track("linux_amd64 download", false)
+	p.Add(1)
+	r.report()
+
+	const clearLine = "\x1b[1A\x1b[2K"
+	display := p.String() + "\n"
+	w := r.Writer(&out)
+	fmt.Fprint(w, "##### Building")
+	fmt.Fprint(w, " Go toolchain\n")
+	p.Finish()
+	fmt.Fprint(w, "done\n")
+
+	// the display is cleared for the output and redrawn below it once the
+	// line is complete
+	want := display + clearLine + "##### Building Go toolchain\n" + display + clearLine + "done\n"
+	if got := out.String(); got != want {
+		t.Errorf("terminal got\n%q\nwant\n%q", got, want)
+	}
+}
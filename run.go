@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// platformEnv returns the environment variables that make the go command
+// of the gonative build at goRoot build for p: its GOROOT, the platform and
+// the C toolchain recorded for it
+func platformEnv(goRoot string, p Platform) ([]string, error) {
+	m, err := readManifest(goRoot)
+	if err != nil {
+		return nil, fmt.Errorf("No gonative build in %s: %v", goRoot, err)
+	}
+	if host := hostPlatform(); m.Host != host.String() {
+		return nil, fmt.Errorf("The build in %s is for a %s host, not %s", goRoot, m.Host, host.String())
+	}
+	if !m.has(p) && p != hostPlatform() {
+		return nil, fmt.Errorf("Platform %s is not part of the build in %s, add it with: gonative build -target=%s -add-platforms=%s", p.String(), goRoot, goRoot, p.String())
+	}
+
+	// the copied packages of older versions need no C toolchain
+	cgoEnv := []string{"CGO_ENABLED=1"}
+	if tc := m.toolchain(p); tc != nil {
+		if cgoEnv, err = tc.env(p); err != nil {
+			return nil, err
+		}
+	}
+
+	env := []string{
+		"GOROOT=" + goRoot,
+		"GOOS=" + p.OS,
+		"GOARCH=" + p.Arch,
+		// don't let go.mod switch to a toolchain without native packages
+		"GOTOOLCHAIN=local",
+	}
+	return append(env, cgoEnv...), nil
+}
+
+// runForPlatform runs the command args with the environment of platformEnv
+// and the build's bin directory first in PATH. It returns the command's exit
+// code.
+func runForPlatform(goRoot string, p Platform, args []string) (int, error) {
+	env, err := platformEnv(goRoot, p)
+	if err != nil {
+		return 0, err
+	}
+
+	// look the command up in the new PATH as well, so go is the build's
+	os.Setenv("PATH", filepath.Join(goRoot, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	Log.Debug("exec", "cmd", args, "env", env)
+
+	// the command gets ctrl-c as well, let it decide what to do. Catching
+	// the signal rather than ignoring it keeps the command from inheriting
+	// an ignored SIGINT.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// report a command killed by a signal the way shells do
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			Log.Debug("command killed", "signal", ws.Signal())
+			return 128 + int(ws.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// platformError reports why a platform failed and what it was doing
+type platformError struct {
+	Platform Platform
+	Phase    string
+	Err      error
+}
+
+func (e *platformError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Platform.String(), e.Phase, e.Err)
+}
+
+// buildError collects the failures of all platforms of a build
+type buildError []*platformError
+
+func (e buildError) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d platforms failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// platformResult is how building one platform went
+type platformResult struct {
+	Platform Platform
+
+	// how the platform's distribution was verified, its URL is empty if
+	// it was never fetched
+	Verification Verification
+
+	Duration time.Duration
+
+	// nil if the platform succeeded
+	Err *platformError
+}
+
+// printStatus writes a table with the outcome of every platform
+func printStatus(w io.Writer, results []platformResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLATFORM\tSTATUS\tTIME\tDETAIL")
+	for _, r := range results {
+		status, detail := "ok", ""
+		if r.Err != nil {
+			status, detail = "FAILED", r.Err.Phase+": "+r.Err.Err.Error()
+		} else if v := r.Verification; v.URL == "" {
+			detail = "built with cgo"
+		} else if v.Weak() {
+			detail = fmt.Sprintf("%s verified (%s, weak), from %s", v.Algo, v.Source, v.Origin)
+		} else if v.Verified() {
+			detail = fmt.Sprintf("%s verified (%s), from %s", v.Algo, v.Source, v.Origin)
+		} else {
+			detail = "unverified, from " + v.Origin
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Platform.String(), status, r.Duration.Round(time.Second), detail)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Go 1.20 stopped shipping precompiled packages in pkg/GOOS_GOARCH, so there
+// is nothing to copy out of its binary distributions. For those versions the
+// cgo-enabled standard library is built for every platform with a cross C
+// compiler instead, which puts it into the build cache where later builds
+// for the platform with the same C toolchain find it.
+var goVersion120 = mustParseGoVersion("1.20")
+
+// shipsPkg reports whether the binary distributions of version come with the
+// precompiled standard library that gonative copies
+func shipsPkg(version GoVersion) bool {
+	return version.Less(goVersion120)
+}
+
+// buildStd builds the standard library for p with cgo enabled using the Go
+// at goRoot and the C toolchain tc
+func buildStd(ctx context.Context, goRoot string, p Platform, tc *crossToolchain) error {
+	cgoEnv, err := tc.env(p)
+	if err != nil {
+		return err
+	}
+
+	cmd := groupCommand(ctx, goCommand(goRoot), "build", "std")
+	cmd.Env = append(os.Environ(),
+		"GOOS="+p.OS,
+		"GOARCH="+p.Arch,
+		"GOROOT="+goRoot)
+	cmd.Env = append(cmd.Env, cgoEnv...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, lastLines(out.String(), 10))
+	}
+	return nil
+}
+
+// goCommand returns the path of the go command of the Go at goRoot
+func goCommand(goRoot string) string {
+	goCmd := filepath.Join(goRoot, "bin", "go")
+	if runtime.GOOS == "windows" {
+		goCmd += ".exe"
+	}
+	return goCmd
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
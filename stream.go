@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+)
+
+// streamable reports whether the archive at url can be unpacked while it
+// downloads. That works for tarballs but not for zip files and installers,
+// which have their directory at the end.
+func streamable(url string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz", ".tar.zst"} {
+		if strings.HasSuffix(url, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamSink feeds a download to the tar extractor and, if keep is set, to
+// a copy of the archive while hashing it
+type streamSink struct {
+	w    *io.PipeWriter
+	keep *os.File
+	h    hash.Hash
+	n    int64
+}
+
+func (s *streamSink) Write(p []byte) (int, error) {
+	if s.keep != nil {
+		if _, err := s.keep.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.w.Write(p)
+	s.h.Write(p[:n])
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *streamSink) Truncate(offset int64) error {
+	if offset != s.n {
+		return fmt.Errorf("cannot resume a streamed download at %d, already have %d bytes", offset, s.n)
+	}
+	if s.keep != nil {
+		if err := s.keep.Truncate(offset); err != nil {
+			return err
+		}
+		_, err := s.keep.Seek(offset, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+// fetchStream extracts the entries of the tarball at url that pass filter
+// into dest while it downloads, without staging the whole archive on disk first.
+// Everything is extracted into a staging directory that is only moved to
+// dest once the checksum of the archive matches. Unless cacheDir is empty,
+// the archive is also kept in the cache, and a verified cached copy is used
+// instead of downloading it again.
+func fetchStream(ctx context.Context, lg log15.Logger, d *downloader, url, cacheDir, dest string, filter *extractFilter, v *Verification) (err error) {
+	staging := dest + ".partial"
+	defer func() {
+		if err != nil {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	var archivePath string
+	if cacheDir != "" {
+		archivePath = cachePath(cacheDir, url, v.Expected)
+		lg = lg.New("cache", archivePath)
+		if f, err := openCached(lg, archivePath, v); err == nil {
+			defer f.Close()
+			lg.Info("using cached download")
+			v.Origin = "cache"
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := unpackTarStream(ctx, staging, f, filter); err != nil {
+				return err
+			}
+			return os.Rename(staging, dest)
+		} else if !os.IsNotExist(err) {
+			lg.Warn("discarding cached download", "err", err)
+			os.Remove(archivePath)
+		}
+	}
+
+	algo, h, err := checksumHash(v.Expected)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	sink := &streamSink{w: pw, h: h}
+	if archivePath != "" {
+		if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+			return err
+		}
+		if sink.keep, err = ioutil.TempFile(filepath.Dir(archivePath), path.Base(url)+"-"); err != nil {
+			return err
+		}
+		defer func() {
+			sink.keep.Close()
+			if err != nil {
+				os.Remove(sink.keep.Name())
+			}
+		}()
+	}
+
+	// stop downloading if extracting fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	extracted := make(chan error, 1)
+	go func() {
+		err := unpackTarStream(ctx, staging, pr, filter)
+		if err == nil {
+			// the rest of the archive, like the padding after the end of
+			// the tar stream, still needs to be hashed
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		if err != nil {
+			cancel()
+		}
+		pr.CloseWithError(err)
+		extracted <- err
+	}()
+
+	lg.Info("start download", "stream", true)
+	prog := progressDisplay.Track(v.Platform.String()+" download", true)
+	err = d.fetchTo(ctx, lg, url, sink, prog)
+	prog.Finish()
+	pw.CloseWithError(err)
+	if xerr := <-extracted; xerr != nil {
+		// the extractor failing is also why writing the download failed
+		err = xerr
+	}
+	if err != nil {
+		return err
+	}
+	v.Algo, v.Digest = algo, hex.EncodeToString(h.Sum(nil))
+	v.Origin = "download"
+	if err = verifyDigest(lg, v); err != nil {
+		return err
+	}
+
+	// commit the extracted files and the cached archive
+	if archivePath != "" {
+		if err = commitCached(sink.keep.Name(), archivePath, v); err != nil {
+			return err
+		}
+	}
+	return os.Rename(staging, dest)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Go is built in a staging directory next to the target and only moved into
+// place once the build succeeded, so a failed build never leaves a half
+// built toolchain behind that looks usable.
+
+// checkTarget refuses to build into an existing target unless it may be
+// replaced
+func checkTarget(targetPath string, force bool) error {
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !force {
+		return fmt.Errorf("Target %s already exists, use -force to replace it", targetPath)
+	}
+	return replaceable(targetPath)
+}
+
+// replaceable refuses to replace targetPath unless it is a Go installation,
+// one built by gonative or a GOROOT with a VERSION file and sources.
+// Anything else, like the current directory, was most likely passed as the
+// target by mistake.
+func replaceable(targetPath string) error {
+	_, manifestErr := os.Stat(filepath.Join(targetPath, manifestName))
+	_, versionErr := os.Stat(filepath.Join(targetPath, "VERSION"))
+	src, srcErr := os.Stat(filepath.Join(targetPath, "src"))
+	if manifestErr != nil && (versionErr != nil || srcErr != nil || !src.IsDir()) {
+		return fmt.Errorf("Target %s is not a Go installation, refusing to replace it", targetPath)
+	}
+	return nil
+}
+
+// stageTarget creates a staging directory next to targetPath, on the same
+// file system so the build can be renamed into place, and returns it along
+// with the path to build in
+func stageTarget(targetPath string) (staging, buildPath string, err error) {
+	staging, err = ioutil.TempDir(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+"-staging-")
+	if err != nil {
+		return "", "", err
+	}
+	return staging, filepath.Join(staging, filepath.Base(targetPath)), nil
+}
+
+// commitTarget moves the finished build at buildPath in staging to
+// targetPath. An existing target is moved into staging first and restored
+// if the build can't take its place.
+func commitTarget(staging, buildPath, targetPath string) error {
+	// the target may have appeared or changed during the build
+	if _, err := os.Lstat(targetPath); err == nil {
+		if err := replaceable(targetPath); err != nil {
+			return err
+		}
+	}
+	old := filepath.Join(staging, "old")
+	if err := os.Rename(targetPath, old); err == nil {
+		Log.Info("replacing existing target", "path", targetPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(buildPath, targetPath); err != nil {
+		os.Rename(old, targetPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckTargetForce(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "target-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	mkdir := func(dir string, files ...string) string {
+		dir = filepath.Join(tmp, dir)
+		if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{filepath.Join(tmp, "missing"), true},
+		{mkdir("gonative", manifestName), true},
+		{mkdir("goroot", "VERSION"), true},
+		{mkdir("project", "main.go"), false},
+		{tmp, false},
+	}
+	for _, tt := range tests {
+		if err := checkTarget(tt.path, false); (err == nil) != (tt.path == filepath.Join(tmp, "missing")) {
+			t.Errorf("%s: checkTarget without force: %v", tt.path, err)
+		}
+		if err := checkTarget(tt.path, true); (err == nil) != tt.ok {
+			t.Errorf("%s: checkTarget with force: %v", tt.path, err)
+		}
+	}
+}
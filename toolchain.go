@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// crossToolchain is the C toolchain cgo uses to build for a platform. It is
+// recorded in the build's manifest and gonative exports it to builds for the
+// platform.
+type crossToolchain struct {
+	CC  string `json:"cc,omitempty"`
+	CXX string `json:"cxx,omitempty"`
+
+	// become CGO_CFLAGS, CGO_CXXFLAGS and CGO_LDFLAGS
+	CFlags   string `json:"cflags,omitempty"`
+	CXXFlags string `json:"cxxflags,omitempty"`
+	LDFlags  string `json:"ldflags,omitempty"`
+
+	// root directory of the platform's headers and libraries, passed to the
+	// compiler and linker with --sysroot
+	Sysroot string `json:"sysroot,omitempty"`
+
+	// "zig" fills in CC and CXX with zig cc for the platform
+	Preset string `json:"preset,omitempty"`
+}
+
+// zigTargets are the zig target triples of the platforms zig cc can build for
+var zigTargets = map[Platform]string{
+	{"linux", "386"}:     "x86-linux-gnu",
+	{"linux", "amd64"}:   "x86_64-linux-gnu",
+	{"linux", "arm"}:     "arm-linux-gnueabihf",
+	{"linux", "arm64"}:   "aarch64-linux-gnu",
+	{"linux", "ppc64le"}: "powerpc64le-linux-gnu",
+	{"linux", "riscv64"}: "riscv64-linux-gnu",
+	{"linux", "s390x"}:   "s390x-linux-gnu",
+	{"windows", "386"}:   "x86-windows-gnu",
+	{"windows", "amd64"}: "x86_64-windows-gnu",
+	{"windows", "arm64"}: "aarch64-windows-gnu",
+	{"darwin", "amd64"}:  "x86_64-macos",
+	{"darwin", "arm64"}:  "aarch64-macos",
+	{"freebsd", "amd64"}: "x86_64-freebsd",
+}
+
+// zigToolchain returns the toolchain using zig cc to build for p
+func zigToolchain(p Platform) (*crossToolchain, error) {
+	target, ok := zigTargets[p]
+	if !ok {
+		return nil, fmt.Errorf("zig cc can't build for %s", p.String())
+	}
+	return &crossToolchain{
+		CC:     "zig cc -target " + target,
+		CXX:    "zig c++ -target " + target,
+		Preset: "zig",
+	}, nil
+}
+
+// LoadToolchains reads a toolchain configuration file. It is a JSON object
+// mapping platforms like linux_arm64 to their toolchains, e.g.
+//
+//	{"linux_arm64": {"cc": "aarch64-linux-gnu-gcc", "sysroot": "/opt/arm64"},
+//	 "windows_amd64": {"preset": "zig"}}
+func LoadToolchains(configPath string) (map[Platform]*crossToolchain, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]*crossToolchain
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Bad toolchain configuration %s: %v", configPath, err)
+	}
+	toolchains := make(map[Platform]*crossToolchain)
+	for name, tc := range config {
+		p, err := parsePlatform(name)
+		if err != nil {
+			return nil, fmt.Errorf("Bad toolchain configuration %s: %v", configPath, err)
+		}
+		if tc == nil {
+			continue
+		}
+		if err := tc.expand(p); err != nil {
+			return nil, fmt.Errorf("Bad toolchain configuration %s: %v", configPath, err)
+		}
+		toolchains[p] = tc
+	}
+	return toolchains, nil
+}
+
+// expand fills in the compilers of the toolchain's preset for p
+func (tc *crossToolchain) expand(p Platform) error {
+	switch tc.Preset {
+	case "":
+		return nil
+	case "zig":
+		zig, err := zigToolchain(p)
+		if err != nil {
+			return err
+		}
+		if tc.CC == "" {
+			tc.CC = zig.CC
+		}
+		if tc.CXX == "" {
+			tc.CXX = zig.CXX
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown toolchain preset %q for %s", tc.Preset, p.String())
+	}
+}
+
+// resolveToolchains picks the toolchain for each of the platforms that don't
+// have one in opts.Toolchains yet: zig cc if opts.Zig is set, otherwise the
+// compiler in CC_FOR_GOOS_GOARCH like make.bash uses. Platforms without
+// either are left out, the host uses the default C compiler. Versions that
+// build the standard library with cgo need a toolchain for every other
+// platform, so it fails before anything is downloaded or built if one has none.
+func resolveToolchains(opts *Options, platforms []Platform) error {
+	if opts.Toolchains == nil {
+		opts.Toolchains = make(map[Platform]*crossToolchain)
+	}
+	for _, p := range platforms {
+		if opts.Toolchains[p] != nil {
+			continue
+		}
+		if opts.Zig && p != hostPlatform() {
+			tc, err := zigToolchain(p)
+			if err != nil {
+				return err
+			}
+			opts.Toolchains[p] = tc
+		} else if cc := os.Getenv("CC_FOR_" + p.OS + "_" + p.Arch); cc != "" {
+			opts.Toolchains[p] = &crossToolchain{CC: cc}
+		}
+	}
+	if shipsPkg(opts.Version) {
+		return nil
+	}
+	var missing []string
+	for _, p := range platforms {
+		if opts.Toolchains[p] == nil && p != hostPlatform() {
+			missing = append(missing, p.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("No C toolchain for %s, configure them with -toolchains, -zig or CC_FOR_GOOS_GOARCH", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// env returns the environment variables that make cgo build for p with the
+// toolchain. A nil toolchain only works for the host.
+func (tc *crossToolchain) env(p Platform) ([]string, error) {
+	env := []string{"CGO_ENABLED=1"}
+	if tc == nil {
+		if p == hostPlatform() {
+			return env, nil
+		}
+		return nil, fmt.Errorf("No C toolchain for %s, configure one with -toolchains or use -zig", p.String())
+	}
+
+	cflags, cxxflags, ldflags := tc.CFlags, tc.CXXFlags, tc.LDFlags
+	if tc.Sysroot != "" {
+		sysroot := "--sysroot=" + tc.Sysroot
+		// setting CGO_CFLAGS replaces cgo's default of -O2 -g
+		cflags = strings.TrimSpace(orDefault(cflags, "-O2 -g") + " " + sysroot)
+		cxxflags = strings.TrimSpace(orDefault(cxxflags, "-O2 -g") + " " + sysroot)
+		ldflags = strings.TrimSpace(orDefault(ldflags, "-O2 -g") + " " + sysroot)
+	}
+	for _, v := range []struct{ name, value string }{
+		{"CC", tc.CC},
+		{"CXX", tc.CXX},
+		{"CGO_CFLAGS", cflags},
+		{"CGO_CXXFLAGS", cxxflags},
+		{"CGO_LDFLAGS", ldflags},
+	} {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value)
+		}
+	}
+	return env, nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
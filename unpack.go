@@ -3,57 +3,206 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archive formats recognized by detectArchive
+const (
+	formatZip    = "zip"
+	formatTar    = "tar"
+	formatTarGz  = "tar.gz"
+	formatTarBz2 = "tar.bz2"
+	formatTarXz  = "tar.xz"
+	formatTarZst = "tar.zst"
+	formatPkg    = "pkg"
+	formatMsi    = "msi"
 )
 
-func unpackFile(dest string, r io.Reader, fname string, mode os.FileMode) error {
-	dir, name := filepath.Split(fname)
-	dirPath := filepath.Join(dest, dir)
-	filePath := filepath.Join(dirPath, name)
-	if !strings.HasPrefix(filePath, dest) {
-		return fmt.Errorf("%q is outside of %s", fname, dest)
-	}
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
+var (
+	magicZip   = []byte("PK\x03\x04")
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicTar   = []byte("ustar")
+)
+
+// detectArchive determines the format of the archive in r from its first
+// bytes, regardless of what it is called
+func detectArchive(r io.ReaderAt) (string, error) {
+	buf := make([]byte, 512)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return detectFormat(buf[:n])
+}
+
+// detectFormat determines the format of an archive that starts with buf
+func detectFormat(buf []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(buf, magicZip):
+		return formatZip, nil
+	case bytes.HasPrefix(buf, magicGzip):
+		return formatTarGz, nil
+	case bytes.HasPrefix(buf, magicBzip2):
+		return formatTarBz2, nil
+	case bytes.HasPrefix(buf, magicXz):
+		return formatTarXz, nil
+	case bytes.HasPrefix(buf, magicZstd):
+		return formatTarZst, nil
+	case bytes.HasPrefix(buf, magicXar):
+		return formatPkg, nil
+	case bytes.HasPrefix(buf, magicCFB):
+		return formatMsi, nil
+	case len(buf) >= 262 && bytes.Equal(buf[257:262], magicTar):
+		return formatTar, nil
+	}
+	return "", fmt.Errorf("Unknown archive format")
+}
+
+// unpackArchive extracts the entries of the archive in r that pass filter
+// into dest, whatever its format
+func unpackArchive(ctx context.Context, dest string, r *os.File, filter *extractFilter) error {
+	format, err := detectArchive(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", r.Name(), err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+
+	switch format {
+	case formatZip:
+		return unpackZip(ctx, dest, r, filter)
+	case formatPkg:
+		return unpackPkg(ctx, dest, r, filter)
+	case formatMsi:
+		return unpackMsi(ctx, dest, r, filter)
+	}
+	rd, err := tarStream(format, r)
 	if err != nil {
 		return err
 	}
+	defer rd.Close()
+	return unpackTar(ctx, dest, rd, filter)
+}
+
+// unpackTarStream extracts the entries that pass filter from the tarball
+// read from r into dest. Unlike unpackArchive it reads the archive front to
+// back, so it can unpack a download as it arrives.
+func unpackTarStream(ctx context.Context, dest string, r io.Reader, filter *extractFilter) error {
+	br := bufio.NewReader(r)
+	buf, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	format, err := detectFormat(buf)
+	if err != nil {
+		return err
+	}
+	rd, err := tarStream(format, br)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return unpackTar(ctx, dest, rd, filter)
+}
+
+// tarStream returns the uncompressed tar stream of a tarball in format
+func tarStream(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case formatTar:
+		return ioutil.NopCloser(r), nil
+	case formatTarGz:
+		return gzip.NewReader(r)
+	case formatTarBz2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case formatTarXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case formatTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%s archives are not tarballs", format)
+}
+
+// unpackLocalArchive extracts the archive at archivePath into a new
+// temporary directory in workDir and returns its path
+func unpackLocalArchive(ctx context.Context, archivePath, workDir string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
 	defer f.Close()
-	_, err = io.Copy(f, r)
-	return err
+	dir, err := ioutil.TempDir(workDir, "src-")
+	if err != nil {
+		return "", err
+	}
+	if err := unpackArchive(ctx, dir, f, nil); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
 }
 
-func unpackTarGz(dest string, r *os.File) error {
-	gr, err := gzip.NewReader(r)
+// unpackTar extracts the entries that pass filter from the tar stream r into
+// dest
+func unpackTar(ctx context.Context, dest string, r io.Reader, filter *extractFilter) error {
+	x, err := newExtractor(ctx, dest, filter)
 	if err != nil {
 		return err
 	}
-	tr := tar.NewReader(gr)
+	tr := tar.NewReader(r)
 	for {
 		f, err := tr.Next()
-		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
+		if err == io.EOF {
+			return x.Close()
+		} else if err != nil {
 			return err
 		}
-		if f.Typeflag != tar.TypeReg && f.Typeflag != tar.TypeReg {
+		if !x.Wants(f.Name) {
 			continue
 		}
-		if err := unpackFile(dest, tr, f.Name, os.FileMode(f.Mode)); err != nil {
+		mode := os.FileMode(f.Mode)
+		switch f.Typeflag {
+		case tar.TypeDir:
+			err = x.Dir(f.Name, mode, f.ModTime)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.File(f.Name, tr, mode, f.ModTime)
+		case tar.TypeSymlink:
+			err = x.Symlink(f.Name, f.Linkname)
+		case tar.TypeLink:
+			err = x.Hardlink(f.Name, f.Linkname)
+		}
+		if err != nil {
 			return err
 		}
 	}
 }
 
-func unpackZip(dest string, r *os.File) error {
+// unpackZip extracts the entries that pass filter from the zip file r into
+// dest
+func unpackZip(ctx context.Context, dest string, r *os.File, filter *extractFilter) error {
 	stat, err := r.Stat()
 	if err != nil {
 		return err
@@ -62,19 +211,37 @@ func unpackZip(dest string, r *os.File) error {
 	if err != nil {
 		return err
 	}
+	x, err := newExtractor(ctx, dest, filter)
+	if err != nil {
+		return err
+	}
 	for _, f := range zr.File {
-		if strings.HasSuffix(f.Name, "/") {
+		if !x.Wants(f.Name) {
 			continue
 		}
-		fr, err := f.Open()
-		if err != nil {
+		if err := unpackZipEntry(x, f); err != nil {
 			return err
 		}
-		err = unpackFile(dest, fr, f.Name, f.Mode())
-		fr.Close()
+	}
+	return x.Close()
+}
+
+func unpackZipEntry(x *extractor, f *zip.File) error {
+	mode := f.Mode()
+	if strings.HasSuffix(f.Name, "/") || mode.IsDir() {
+		return x.Dir(f.Name, mode, f.Modified)
+	}
+	fr, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	if mode&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(fr, 4096))
 		if err != nil {
 			return err
 		}
+		return x.Symlink(f.Name, string(target))
 	}
-	return nil
+	return x.File(f.Name, fr, mode, f.Modified)
 }
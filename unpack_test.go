@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var testModTime = time.Date(2015, 8, 19, 12, 0, 0, 0, time.UTC)
+
+// makeTar writes a tarball of hdrs, with the contents of regular files taken
+// from their Linkname
+func makeTar(t *testing.T, hdrs ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range hdrs {
+		var body []byte
+		if h.Typeflag == tar.TypeReg {
+			body = []byte(h.Linkname)
+			h.Linkname = ""
+			h.Size = int64(len(body))
+		}
+		if h.ModTime.IsZero() {
+			h.ModTime = testModTime
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// asRegA turns the first entry of tarball into an old style regular file
+// with the type flag '\x00', which archive/tar won't write itself
+func asRegA(tarball []byte) {
+	hdr := tarball[:512]
+	hdr[156] = tar.TypeRegA
+	copy(hdr[148:156], "        ")
+	var sum int
+	for _, b := range hdr {
+		sum += int(b)
+	}
+	copy(hdr[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+func file(name, contents string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Linkname: contents}
+}
+
+func unpackTestTar(t *testing.T, tarball []byte) (string, error) {
+	dest, err := ioutil.TempDir("", "unpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest, unpackTar(context.Background(), dest, bytes.NewReader(tarball), nil)
+}
+
+// removeAll removes dest even if unpacking left read-only directories in it
+func removeAll(dest string) {
+	filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+	os.RemoveAll(dest)
+}
+
+func readTestFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUnpackTarFiles(t *testing.T) {
+	tarball := makeTar(t,
+		file("go/VERSION", "go1.4.3"),
+		&tar.Header{Name: "go/pkg/", Typeflag: tar.TypeDir, Mode: 0555},
+		file("go/pkg/runtime.a", "runtime"),
+		&tar.Header{Name: "go/pkg/link.a", Typeflag: tar.TypeLink, Linkname: "go/pkg/runtime.a"},
+		&tar.Header{Name: "go/bin/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: testModTime.Add(time.Hour)},
+		&tar.Header{Name: "go/bin/gofmt", Typeflag: tar.TypeSymlink, Linkname: "../pkg/tool/gofmt"},
+	)
+	asRegA(tarball)
+	dest, err := unpackTestTar(t, tarball)
+	defer removeAll(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTestFile(t, filepath.Join(dest, "go", "VERSION")); got != "go1.4.3" {
+		t.Errorf("old style regular file has %q, want %q", got, "go1.4.3")
+	}
+
+	for name, want := range map[string]struct {
+		mode    os.FileMode
+		modTime time.Time
+	}{
+		"pkg": {0555, testModTime},
+		"bin": {0750, testModTime.Add(time.Hour)},
+	} {
+		fi, err := os.Stat(filepath.Join(dest, "go", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want.mode {
+			t.Errorf("%s has mode %v, want %v", name, fi.Mode().Perm(), want.mode)
+		}
+		if !fi.ModTime().Equal(want.modTime) {
+			t.Errorf("%s has mod time %v, want %v", name, fi.ModTime(), want.modTime)
+		}
+	}
+
+	orig, err := os.Stat(filepath.Join(dest, "go", "pkg", "runtime.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(filepath.Join(dest, "go", "pkg", "link.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(orig, link) {
+		t.Error("hard link is a copy")
+	}
+
+	// symlinks are extracted as they are, even if their target is missing
+	target, err := os.Readlink(filepath.Join(dest, "go", "bin", "gofmt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../pkg/tool/gofmt" {
+		t.Errorf("symlink points to %q, want %q", target, "../pkg/tool/gofmt")
+	}
+}
+
+func TestUnpackTarRefuses(t *testing.T) {
+	tests := []struct {
+		name string
+		hdrs []*tar.Header
+	}{
+		{"dotdot", []*tar.Header{file("go/../../evil", "x")}},
+		{"absolute", []*tar.Header{file("/tmp/evil", "x")}},
+		{"escaping symlink", []*tar.Header{
+			{Name: "go/up", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		}},
+		{"absolute symlink", []*tar.Header{
+			{Name: "go/etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		}},
+		{"symlink chain", []*tar.Header{
+			{Name: "go/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "go/esc", Typeflag: tar.TypeSymlink, Linkname: "up/.."},
+		}},
+		{"symlink chain in reverse", []*tar.Header{
+			{Name: "go/esc", Typeflag: tar.TypeSymlink, Linkname: "up/.."},
+			{Name: "go/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		}},
+		{"symlink replacing a directory", []*tar.Header{
+			{Name: "go/pkg/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "go/pkg", Typeflag: tar.TypeSymlink, Linkname: "."},
+		}},
+		{"write through symlink", []*tar.Header{
+			{Name: "go/lib", Typeflag: tar.TypeSymlink, Linkname: "pkg"},
+			file("go/lib/evil", "x"),
+		}},
+		{"hard link outside", []*tar.Header{
+			{Name: "go/passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+		}},
+		{"hard link to symlink", []*tar.Header{
+			{Name: "go/self", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "go/link", Typeflag: tar.TypeLink, Linkname: "go/self"},
+		}},
+		{"hard link to missing file", []*tar.Header{
+			{Name: "go/link", Typeflag: tar.TypeLink, Linkname: "go/missing"},
+		}},
+	}
+	for _, tt := range tests {
+		dest, err := unpackTestTar(t, makeTar(t, tt.hdrs...))
+		removeAll(dest)
+		if _, ok := err.(*extractError); !ok {
+			t.Errorf("%s: got %v, want an extract error", tt.name, err)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tarball := makeTar(t, file("go/VERSION", "go1.5.2"))
+	tests := []struct {
+		buf    []byte
+		format string
+	}{
+		{[]byte("PK\x03\x04rest"), formatZip},
+		{[]byte{0x1f, 0x8b, 0x08, 0x00}, formatTarGz},
+		{[]byte("BZh91AY&SY"), formatTarBz2},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}, formatTarXz},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x24}, formatTarZst},
+		{[]byte("xar!\x00\x1c"), formatPkg},
+		{[]byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}, formatMsi},
+		{tarball, formatTar},
+		{[]byte("#!/bin/sh"), ""},
+		{nil, ""},
+		// too short for the tar magic
+		{tarball[:260], ""},
+	}
+	for _, tt := range tests {
+		format, err := detectFormat(tt.buf)
+		if tt.format == "" {
+			if err == nil {
+				t.Errorf("detectFormat(%q) = %s, want an error", tt.buf, format)
+			}
+		} else if format != tt.format || err != nil {
+			t.Errorf("detectFormat of a %s archive = %s, %v", tt.format, format, err)
+		}
+	}
+}
+
+func TestUnpackTarStreamCompressed(t *testing.T) {
+	tarball := makeTar(t, file("go/VERSION", "go1.21.0"))
+	compressors := map[string]func(io.Writer) (io.WriteCloser, error){
+		formatTar: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		formatTarGz: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		formatTarXz: func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		formatTarZst: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+	for format, compress := range compressors {
+		var buf bytes.Buffer
+		w, err := compress(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(tarball)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		archive := buf.Bytes()
+		if detected, err := detectFormat(archive); detected != format {
+			t.Errorf("%s detected as %s, %v", format, detected, err)
+		}
+
+		dest, err := ioutil.TempDir("", "unpack-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = unpackTarStream(context.Background(), dest, bytes.NewReader(archive), nil)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+		} else if got := readTestFile(t, filepath.Join(dest, "go", "VERSION")); got != "go1.21.0" {
+			t.Errorf("%s: extracted %q, want %q", format, got, "go1.21.0")
+		}
+		os.RemoveAll(dest)
+
+		// a truncated stream must fail instead of extracting what's there,
+		// only a plain tarball cut at an entry can't tell
+		if err := unpackTestTarStream(t, archive[:len(archive)/2]); err == nil && format != formatTar {
+			t.Errorf("%s: truncated archive unpacked without error", format)
+		}
+	}
+}
+
+func unpackTestTarStream(t *testing.T, archive []byte) error {
+	dest, err := ioutil.TempDir("", "unpack-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	return unpackTarStream(context.Background(), dest, bytes.NewReader(archive), nil)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
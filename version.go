@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// pre-release kinds, ordered so that betas sort before release candidates
+// which sort before the final release
+const (
+	preBeta = iota + 1
+	preRC
+	preNone
+)
+
+var goVersionRe = regexp.MustCompile(`^(?:go)?(\d+)\.(\d+)(?:\.(\d+))?(?:(beta|rc)(\d+))?$`)
+
+// GoVersion is a parsed Go release version like 1.4, 1.3.3 or 1.5beta2
+type GoVersion struct {
+	Major int
+	Minor int
+	Patch int
+
+	// Pre is "beta", "rc" or "" for a final release
+	Pre    string
+	PreNum int
+}
+
+// ParseGoVersion parses a version string as used in Go release names.
+// A leading "go" is accepted and ignored.
+func ParseGoVersion(s string) (v GoVersion, err error) {
+	m := goVersionRe.FindStringSubmatch(s)
+	if m == nil {
+		return v, fmt.Errorf("Invalid Go version %q, expected something like 1.5.2, 1.4 or 1.5rc1", s)
+	}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	if m[4] != "" {
+		if m[3] != "" {
+			return v, fmt.Errorf("Invalid Go version %q, pre-releases don't have a patch number", s)
+		}
+		v.Pre = m[4]
+		v.PreNum, _ = strconv.Atoi(m[5])
+	}
+	return v, nil
+}
+
+// mustParseGoVersion is like ParseGoVersion but panics on error. It is
+// meant for version constants compiled into gonative.
+func mustParseGoVersion(s string) GoVersion {
+	v, err := ParseGoVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// String formats v the way Go release names do. The first release of a
+// version is called 1.5 before Go 1.21 and 1.21.0 from then on, so 1.21 and
+// 1.21.0 are the same version.
+func (v GoVersion) String() string {
+	s := fmt.Sprintf("%d.%d", v.Major, v.Minor)
+	if v.Patch != 0 || v.Pre == "" && (v.Major > 1 || v.Minor >= 21) {
+		s += fmt.Sprintf(".%d", v.Patch)
+	}
+	if v.Pre != "" {
+		s += fmt.Sprintf("%s%d", v.Pre, v.PreNum)
+	}
+	return s
+}
+
+func (v GoVersion) preRank() int {
+	switch v.Pre {
+	case "beta":
+		return preBeta
+	case "rc":
+		return preRC
+	default:
+		return preNone
+	}
+}
+
+// Compare returns -1, 0 or 1 if v is older than, the same as or newer than o
+func (v GoVersion) Compare(o GoVersion) int {
+	pairs := [][2]int{
+		{v.Major, o.Major},
+		{v.Minor, o.Minor},
+		{v.Patch, o.Patch},
+		{v.preRank(), o.preRank()},
+		{v.PreNum, o.PreNum},
+	}
+	for _, p := range pairs {
+		switch {
+		case p[0] < p[1]:
+			return -1
+		case p[0] > p[1]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Less reports whether v is older than o
+func (v GoVersion) Less(o GoVersion) bool {
+	return v.Compare(o) < 0
+}
+
+// AtMost reports whether v is the same as or older than o
+func (v GoVersion) AtMost(o GoVersion) bool {
+	return v.Compare(o) <= 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestParseGoVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want GoVersion
+		str  string
+	}{
+		{"go1.5.2", GoVersion{Major: 1, Minor: 5, Patch: 2}, "1.5.2"},
+		{"1.4", GoVersion{Major: 1, Minor: 4}, "1.4"},
+		{"1.5.0", GoVersion{Major: 1, Minor: 5}, "1.5"},
+		{"1.21", GoVersion{Major: 1, Minor: 21}, "1.21.0"},
+		{"1.21.0", GoVersion{Major: 1, Minor: 21}, "1.21.0"},
+		{"1.21rc2", GoVersion{Major: 1, Minor: 21, Pre: "rc", PreNum: 2}, "1.21rc2"},
+		{"1.4beta1", GoVersion{Major: 1, Minor: 4, Pre: "beta", PreNum: 1}, "1.4beta1"},
+	}
+	for _, tt := range tests {
+		v, err := ParseGoVersion(tt.in)
+		if err != nil {
+			t.Errorf("ParseGoVersion(%q): %v", tt.in, err)
+			continue
+		}
+		if v != tt.want {
+			t.Errorf("ParseGoVersion(%q) = %#v, want %#v", tt.in, v, tt.want)
+		}
+		if v.String() != tt.str {
+			t.Errorf("ParseGoVersion(%q).String() = %q, want %q", tt.in, v.String(), tt.str)
+		}
+	}
+
+	for _, in := range []string{"", "1", "go", "1.x", "1.5.2rc1", "1.5beta", "v1.5", "1.5 ", "1.21.0.1"} {
+		if v, err := ParseGoVersion(in); err == nil {
+			t.Errorf("ParseGoVersion(%q) = %v, want an error", in, v)
+		}
+	}
+}
+
+func TestGoVersionCompare(t *testing.T) {
+	// oldest first
+	ordered := []string{"1.4beta1", "1.4rc1", "1.4rc2", "1.4", "1.4.3", "1.5.2", "1.10", "1.21rc2", "1.21", "1.21.1", "2.0"}
+	for i, a := range ordered {
+		va := mustParseGoVersion(a)
+		for j, b := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := va.Compare(mustParseGoVersion(b)); got != want {
+				t.Errorf("%s.Compare(%s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+
+	a, b := mustParseGoVersion("1.21"), mustParseGoVersion("go1.21.0")
+	if a.Compare(b) != 0 || a != b {
+		t.Errorf("1.21 and 1.21.0 differ: %#v, %#v", a, b)
+	}
+}